@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// adminPrefix is where Bloodhound's own endpoints live, other paths below
+// it are proxied like any other request
+const adminPrefix = "/.bloodhound/"
+
+// serveAdmin answers requests for enabled admin endpoints and reports
+// whether it did. The endpoints share the proxied listener, so they are only
+// served with AdminToken set and to requests presenting it.
+func (sp *SniffingProxy) serveAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.AdminToken == "" {
+		return false
+	}
+	switch r.URL.Path {
+	case adminPrefix + "dump", adminPrefix + "stream":
+		if !adminAuthorized(r) {
+			log.Warn().Str("phase", "admin").Str("method", r.Method).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Admin request without a valid token")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return true
+		}
+	}
+	switch r.URL.Path {
+	case adminPrefix + "dump":
+		if ring != nil {
+			ring.serveDump(w, r)
+			return true
+		}
+	case adminPrefix + "stream":
+		if live != nil {
+			live.serve(w, r)
+			return true
+		}
+	}
+	return false
+}
+
+// adminAuthorized reports whether r carries AdminToken as a bearer token
+func adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
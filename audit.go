@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// auditGenesis is the previous hash of the first line in an audit log
+var auditGenesis = strings.Repeat("0", 64)
+
+// auditEntry is one line of the audit log. Prev is the SHA-256 of the
+// previous line, so altering or removing a line breaks the chain.
+type auditEntry struct {
+	Prev       string    `json:"prev"`
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"statusCode"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	Duration   string    `json:"duration"`
+}
+
+// auditLog appends hash chained entries to AuditLog
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	prev string
+}
+
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	prev, err := lastAuditHash(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, prev: prev}, nil
+}
+
+// lastAuditHash continues the chain of an existing audit log
+func lastAuditHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return auditGenesis, nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	prev := auditGenesis
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			prev = auditHash(line)
+		}
+		if err == io.EOF {
+			return prev, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// auditHash hashes a line without its trailing newline
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(bytes.TrimRight(line, "\r\n"))
+	return hex.EncodeToString(sum[:])
+}
+
+func (al *auditLog) append(entry auditEntry, reqID string) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	entry.Prev = al.prev
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR encoding audit entry : %v", err)
+		return
+	}
+	if _, err := al.file.Write(append(line, '\n')); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR writing audit log : %v", err)
+		return
+	}
+	al.prev = auditHash(line)
+}
+
+func (al *auditLog) close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
+
+// verifyAuditLog checks the hash chain of an audit log, returning the number
+// of valid entries or an error naming the first broken line
+func verifyAuditLog(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	prev := auditGenesis
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return lines - 1, fmt.Errorf("line %d: %v", lines, err)
+		}
+		if entry.Prev != prev {
+			return lines - 1, fmt.Errorf("line %d: chain broken, expected prev %s got %s", lines, prev, entry.Prev)
+		}
+		prev = auditHash(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, err
+	}
+	return lines, nil
+}
@@ -2,35 +2,304 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	stdlog "log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/andybalholm/brotli"
 	"github.com/caarlos0/env/v11"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
 )
 
 type Config struct {
 	TargetUrl  string `env:"TargetUrl" envDefault:"https://httpbin.org"`
 	ListenAddr string `env:"ListenAddr" envDefault:"0.0.0.0:25663"`
 	BoneFolder string `env:"BoneFolder" envDEfault:""`
+
+	BoneFolderErrors        string  `env:"BoneFolderErrors" envDefault:""`
+	BoneRotate              int     `env:"BoneRotate" envDefault:"0"`
+	RingSize                int     `env:"RingSize" envDefault:"0"`
+	BoneDB                  string  `env:"BoneDB" envDefault:""`
+	AuditLog                string  `env:"AuditLog" envDefault:""`
+	OpenAPIExamples         string  `env:"OpenAPIExamples" envDefault:""`
+	RecordReplay            string  `env:"RecordReplay" envDefault:""`
+	ReplayMode              string  `env:"ReplayMode" envDefault:"record"`
+	CaptureOnce             string  `env:"CaptureOnce" envDefault:""`
+	CaptureTriggerHeader    string  `env:"CaptureTriggerHeader" envDefault:""`
+	MaxCaptureRate          float64 `env:"MaxCaptureRate" envDefault:"0"`
+	CaptureIfResponseHeader string  `env:"CaptureIfResponseHeader" envDefault:""`
+	RawCapture              bool    `env:"RawCapture" envDefault:"false"`
+	WireCapture             bool    `env:"WireCapture" envDefault:"false"`
+	GoTestExport            bool    `env:"GoTestExport" envDefault:"false"`
+
+	ShutdownTimeout         time.Duration `env:"ShutdownTimeout" envDefault:"10s"`
+	DrainPeriod             time.Duration `env:"DrainPeriod" envDefault:"0"`
+	SelfTest                bool          `env:"SelfTest" envDefault:"false"`
+	StatsInterval           time.Duration `env:"StatsInterval" envDefault:"0"`
+	HeartbeatInterval       time.Duration `env:"HeartbeatInterval" envDefault:"0"`
+	UsageInterval           time.Duration `env:"UsageInterval" envDefault:"0"`
+	UsageCumulative         bool          `env:"UsageCumulative" envDefault:"false"`
+	LiveStream              bool          `env:"LiveStream" envDefault:"false"`
+	AdminToken              string        `env:"AdminToken" envDefault:""`
+	CloudEventsSink         string        `env:"CloudEventsSink" envDefault:""`
+	ServerReadTimeout       time.Duration `env:"ServerReadTimeout" envDefault:"30s"`
+	ServerReadHeaderTimeout time.Duration `env:"ServerReadHeaderTimeout" envDefault:"10s"`
+	ServerWriteTimeout      time.Duration `env:"ServerWriteTimeout" envDefault:"60s"`
+	ServerIdleTimeout       time.Duration `env:"ServerIdleTimeout" envDefault:"120s"`
+
+	DialLocalAddr        string        `env:"DialLocalAddr" envDefault:""`
+	UpstreamProxy        string        `env:"UpstreamProxy" envDefault:""`
+	UpstreamCertFile     string        `env:"UpstreamCertFile" envDefault:""`
+	UpstreamKeyFile      string        `env:"UpstreamKeyFile" envDefault:""`
+	MaxIdleConns         int           `env:"MaxIdleConns" envDefault:"100"`
+	MaxIdleConnsPerHost  int           `env:"MaxIdleConnsPerHost" envDefault:"2"`
+	DisableKeepAlives    bool          `env:"DisableKeepAlives" envDefault:"false"`
+	CoalesceGETs         bool          `env:"CoalesceGETs" envDefault:"false"`
+	FollowRedirects      int           `env:"FollowRedirects" envDefault:"0"`
+	MaxUpstreamConns     int           `env:"MaxUpstreamConns" envDefault:"0"`
+	UpstreamQueueTimeout time.Duration `env:"UpstreamQueueTimeout" envDefault:"30s"`
+
+	RequestIDFormat string `env:"RequestIDFormat" envDefault:"counter"`
+
+	MaxHeaderBytes  int   `env:"MaxHeaderBytes" envDefault:"1048576"`
+	MaxURLLength    int   `env:"MaxURLLength" envDefault:"16384"`
+	MaxRequestBytes int64 `env:"MaxRequestBytes" envDefault:"0"`
+
+	GlobalRateLimit  float64       `env:"GlobalRateLimit" envDefault:"0"`
+	GlobalRateBurst  int           `env:"GlobalRateBurst" envDefault:"50"`
+	RateLimit        float64       `env:"RateLimit" envDefault:"0"`
+	RateBurst        int           `env:"RateBurst" envDefault:"10"`
+	RouteRateLimits  []string      `env:"RouteRateLimits" envSeparator:","`
+	RateMode         string        `env:"RateMode" envDefault:"reject"`
+	MaxThrottleDelay time.Duration `env:"MaxThrottleDelay" envDefault:"5s"`
+
+	EchoMode     bool     `env:"EchoMode" envDefault:"false"`
+	LocalPaths   []string `env:"LocalPaths" envSeparator:","`
+	ForwardProxy bool     `env:"ForwardProxy" envDefault:"false"`
+
+	ShadowTarget string   `env:"ShadowTarget" envDefault:""`
+	RouteRules   []string `env:"RouteRules" envSeparator:","`
+	LatencyRules []string `env:"LatencyRules" envSeparator:","`
+
+	ColdStartDelay    time.Duration `env:"ColdStartDelay" envDefault:"0"`
+	IdleResetDuration time.Duration `env:"IdleResetDuration" envDefault:"0"`
+
+	StripPathPrefix string `env:"StripPathPrefix" envDefault:""`
+	AddPathPrefix   string `env:"AddPathPrefix" envDefault:""`
+	TrailingSlash   string `env:"TrailingSlash" envDefault:"preserve"`
+
+	HonorMethodOverride bool   `env:"HonorMethodOverride" envDefault:"false"`
+	InjectTraceHeader   string `env:"InjectTraceHeader" envDefault:"X-Bloodhound-ID"`
+	SessionCookie       string `env:"SessionCookie" envDefault:""`
+	CORSOrigin          string `env:"CORSOrigin" envDefault:""`
+	EmitTimingHeader    bool   `env:"EmitTimingHeader" envDefault:"false"`
+
+	AllowedRequestTypes []string `env:"AllowedRequestTypes" envSeparator:","`
+
+	RequestTimeout       time.Duration `env:"RequestTimeout" envDefault:"0"`
+	CaptureOnClientAbort bool          `env:"CaptureOnClientAbort" envDefault:"false"`
+
+	ThrottleBytesPerSec int `env:"ThrottleBytesPerSec" envDefault:"0"`
+
+	SlowThreshold          time.Duration `env:"SlowThreshold" envDefault:"0"`
+	CaptureSlowerThan      time.Duration `env:"CaptureSlowerThan" envDefault:"0"`
+	LargeResponseThreshold int64         `env:"LargeResponseThreshold" envDefault:"0"`
+	LogBodyPreview         int           `env:"LogBodyPreview" envDefault:"0"`
+	LogSampleRate          float64       `env:"LogSampleRate" envDefault:"1"`
+	LogQuery               bool          `env:"LogQuery" envDefault:"false"`
+	RedactQueryParams      []string      `env:"RedactQueryParams" envSeparator:","`
+
+	DetectContentType bool `env:"DetectContentType" envDefault:"false"`
+	FixContentType    bool `env:"FixContentType" envDefault:"false"`
+	XMLToJSON         bool `env:"XMLToJSON" envDefault:"false"`
+
+	DedupBodies       bool `env:"DedupBodies" envDefault:"false"`
+	DiffReqResp       bool `env:"DiffReqResp" envDefault:"false"`
+	MinBodyCapture    int  `env:"MinBodyCapture" envDefault:"0"`
+	MaxBodyCapture    int  `env:"MaxBodyCapture" envDefault:"0"`
+	BodyHeadTailBytes int  `env:"BodyHeadTailBytes" envDefault:"0"`
+
+	BoneBodyEncoding   string   `env:"BoneBodyEncoding" envDefault:"raw"`
+	BoneMetadata       bool     `env:"BoneMetadata" envDefault:"false"`
+	BoneMetadataPrefix string   `env:"BoneMetadataPrefix" envDefault:"# "`
+	NoBodyCaptureTypes []string `env:"NoBodyCaptureTypes" envDefault:"video/,audio/,application/octet-stream" envSeparator:","`
+
+	HeadersOnly        bool     `env:"HeadersOnly" envDefault:"false"`
+	CaptureHeaders     []string `env:"CaptureHeaders" envSeparator:","`
+	RedactJSONFields   []string `env:"RedactJSONFields" envSeparator:","`
+	HashIncludeHeaders []string `env:"HashIncludeHeaders" envSeparator:","`
+	HashIncludeBody    bool     `env:"HashIncludeBody" envDefault:"false"`
+	NormalizeHeaders   []string `env:"NormalizeHeaders" envDefault:"Date" envSeparator:","`
+	HeaderCase         string   `env:"HeaderCase" envDefault:"original"`
+
+	BoneHook        string `env:"BoneHook" envDefault:""`
+	BoneHookWorkers int    `env:"BoneHookWorkers" envDefault:"4"`
+
+	BoneWriteWorkers      int    `env:"BoneWriteWorkers" envDefault:"4"`
+	StrictCapture         bool   `env:"StrictCapture" envDefault:"false"`
+	BoneWriteQueue        int    `env:"BoneWriteQueue" envDefault:"256"`
+	BoneWriteBackpressure string `env:"BoneWriteBackpressure" envDefault:"block"`
 }
 
 var cfg Config
 var requestIdCounter int64
 
+// draining is set once shutdown starts shedding keep-alive connections
+var draining atomic.Bool
+var startTime = time.Now()
+var boneHookQueue chan string
+var captureHeaders map[string]bool
+var normalizeHeaders map[string]bool
+
+// seenBodies maps the SHA-256 of every stored response body to the bone
+// that holds it when DedupBodies is enabled
+var seenBodies = struct {
+	sync.Mutex
+	files map[string]string
+}{files: make(map[string]string)}
+
+// Exit codes let orchestration tell configuration mistakes apart from
+// network trouble
+const (
+	exitConfig   = 2
+	exitUpstream = 3
+	exitBind     = 4
+)
+
+// fatal logs at FATAL level and exits with the given code
+func fatal(code int, format string, args ...any) {
+	log.WithLevel(zerolog.FatalLevel).Int("exitCode", code).Msgf(format, args...)
+	os.Exit(code)
+}
+
 const requestIDKey = "requestID"
+const clientContextKey = "clientContext"
+const transactionKey = "transaction"
+
+// transaction carries per request state from the proxy hooks back to
+// ServeHTTP for the completion log line
+type transaction struct {
+	capture     bool
+	bodyPreview string
+	requestHash string
+	// unsampled transactions skip their INFO request, response and
+	// completion lines under LogSampleRate
+	unsampled bool
+	// session is the client's SessionCookie value
+	session string
+	// forced captures were requested through CaptureTriggerHeader and are
+	// written whatever limits and filters would decide
+	forced bool
+
+	start time.Time
+	// upstreamStart is when the request left for the upstream
+	upstreamStart time.Time
+	// upstreamIP is the address of the upstream connection that carried
+	// the request
+	upstreamIP string
+
+	// requestBody and responseBody are the captured bodies, kept for
+	// exporters that run once the response arrives
+	requestBody  []byte
+	responseBody []byte
+
+	// wireHops counts the upstream round trips WireCapture dumped, one per
+	// redirect followed
+	wireHops int
+
+	// primaryResult hands the primary response to a running shadow request
+	primaryResult chan *shadowResult
+
+	// captureFailed is set when one of the transaction's bones could not be
+	// written
+	captureFailed bool
+
+	// pending holds request bones until the response decides which folder
+	// the transaction's bones belong in
+	pending []pendingBone
+}
+
+// pendingBone is a bone that has been dumped but not yet written
+type pendingBone struct {
+	name string
+	time time.Time
+	data []byte
+}
+
+// info starts an INFO log line of the transaction, nil (which zerolog
+// ignores) when LogSampleRate left it out
+func (tx *transaction) info() *zerolog.Event {
+	if tx.unsampled {
+		return nil
+	}
+	return tx.annotate(log.Info())
+}
+
+// annotate adds the fields shared by every log line of the transaction
+func (tx *transaction) annotate(event *zerolog.Event) *zerolog.Event {
+	if tx.session != "" {
+		event = event.Str("session", tx.session)
+	}
+	return event
+}
+
+// logSampled reports whether request n is among the LogSampleRate fraction
+// that is logged, spreading them evenly over the counter
+func logSampled(n int64) bool {
+	if cfg.LogSampleRate >= 1 {
+		return true
+	}
+	return math.Floor(float64(n)*cfg.LogSampleRate) != math.Floor(float64(n-1)*cfg.LogSampleRate)
+}
+
+func transactionFrom(ctx context.Context) *transaction {
+	if tx, ok := ctx.Value(transactionKey).(*transaction); ok {
+		return tx
+	}
+	return &transaction{}
+}
 
 type SniffingProxy struct {
-	target *url.URL
-	proxy  *httputil.ReverseProxy
+	target        *url.URL
+	proxy         *httputil.ReverseProxy
+	shadow        *shadow
+	routes        []routeRule
+	routeLimits   []routeRateLimit
+	latency       []latencyRule
+	globalLimiter *rate.Limiter
+	limiters      *clientLimiters
 }
 
 func NewSniffingProxy(target string) (*SniffingProxy, error) {
@@ -40,171 +309,1756 @@ func NewSniffingProxy(target string) (*SniffingProxy, error) {
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(url)
+	transport, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	proxy.Transport = transport
 
 	sp := &SniffingProxy{
 		target: url,
 		proxy:  proxy,
 	}
+	if cfg.MaxUpstreamConns > 0 {
+		limited := newLimitedTransport(proxy.Transport, cfg.MaxUpstreamConns)
+		go limited.logQueue(10 * time.Second)
+		proxy.Transport = limited
+	}
+	if cfg.WireCapture {
+		proxy.Transport = &wireTransport{sp: sp, next: proxy.Transport}
+	}
+	if cfg.FollowRedirects > 0 {
+		proxy.Transport = &redirectTransport{next: proxy.Transport}
+	}
+	if cfg.CoalesceGETs {
+		proxy.Transport = newCoalescingTransport(proxy.Transport)
+	}
+	if sp.routes, err = parseRouteRules(cfg.RouteRules); err != nil {
+		return nil, err
+	}
+	if sp.latency, err = parseLatencyRules(cfg.LatencyRules); err != nil {
+		return nil, err
+	}
+	if len(cfg.ShadowTarget) > 0 {
+		if sp.shadow, err = newShadow(cfg.ShadowTarget, transport); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.GlobalRateLimit > 0 {
+		sp.globalLimiter = rate.NewLimiter(rate.Limit(cfg.GlobalRateLimit), max(cfg.GlobalRateBurst, 1))
+	}
+	if cfg.RateLimit > 0 {
+		sp.limiters = newClientLimiters(cfg.RateLimit, cfg.RateBurst)
+	}
+	if sp.routeLimits, err = parseRouteRateLimits(cfg.RouteRateLimits); err != nil {
+		return nil, err
+	}
 
 	// Customize the proxy to add Sniffing
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
+		clientPath := req.URL.Path
+		// Rewrite before originalDirector joins the target's own base path
+		rewritePath(req.URL, rewritePathPrefix)
+		if cfg.TrailingSlash != "preserve" {
+			rewritePath(req.URL, normalizeTrailingSlash)
+			if req.URL.Path != clientPath {
+				reqID, _ := req.Context().Value(requestIDKey).(string)
+				log.Info().Str("phase", "normalize").Str("trailingSlash", cfg.TrailingSlash).Str("from", clientPath).Str("to", req.URL.Path).Str("id", reqID).Msg("Normalized trailing slash")
+			}
+		}
+		clientURL := *req.URL
+		if !isForwardRequest(req) {
+			if route := sp.matchRoute(req); route != nil {
+				reqID, _ := req.Context().Value(requestIDKey).(string)
+				log.Info().Str("phase", "route").Str("method", req.Method).Str("url", clientPath).Str("header", route.header).Str("value", route.value).Str("target", route.target.String()).Str("id", reqID).Msg("Route matched")
+				route.director(req)
+			} else {
+				originalDirector(req)
+			}
+			if strings.HasPrefix(cfg.UpstreamProxy, "http") {
+				// Go builds the absolute URI for an HTTP proxy from Host, the
+				// client's Host would send the request straight back to us
+				req.Host = ""
+			}
+		}
+		if cfg.HonorMethodOverride {
+			overrideMethod(req)
+		}
 		if reqID := req.Context().Value(requestIDKey); reqID != nil {
-			sp.sniffRequest(req, reqID.(int64))
-			if len(cfg.BoneFolder) > 0 {
-				sp.writeRequestToFile(req, reqID.(int64))
+			if traceHeader() != "" {
+				req.Header.Set(traceHeader(), reqID.(string))
+			}
+			setRequestHash(req, clientPath)
+			sp.sniffRequest(req, clientPath, reqID.(string))
+			if tx := transactionFrom(req.Context()); tx.capture {
+				sp.writeRequestToFile(req, reqID.(string))
+			} else if sp.bufferBodies() {
+				tx.requestBody = readRequestBody(req)
 			}
+			if sp.shadow != nil && !isForwardRequest(req) {
+				sp.shadow.start(req, clientURL, transactionFrom(req.Context()), reqID.(string))
+			}
+			traceUpstreamIP(req)
+			transactionFrom(req.Context()).upstreamStart = time.Now()
 		}
 	}
 
 	// Add response Sniffing
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		// ServeHTTP already set our own value for the client
+		if traceHeader() != "" {
+			resp.Header.Del(traceHeader())
+		}
+		if len(cfg.CORSOrigin) > 0 {
+			setCORSHeaders(resp.Header, resp.Request)
+		}
+		if cfg.EmitTimingHeader {
+			// Add keeps any Server-Timing metrics the upstream reported
+			upstream := time.Since(transactionFrom(resp.Request.Context()).upstreamStart)
+			resp.Header.Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f", float64(upstream)/float64(time.Millisecond)))
+		}
 		if reqID := resp.Request.Context().Value(requestIDKey); reqID != nil {
-			sp.sniffResponse(resp, reqID.(int64))
-			if len(cfg.BoneFolder) > 0 {
-				sp.writeResponseToFile(resp, reqID.(int64))
+			// HeadersOnly leaves response bodies unread until the client gets them
+			if cfg.DetectContentType && !cfg.HeadersOnly {
+				sp.detectResponseType(resp, reqID.(string))
+			}
+			if cfg.XMLToJSON && !cfg.HeadersOnly {
+				convertXMLResponse(resp, reqID.(string))
+			}
+			sp.sniffResponse(resp, reqID.(string))
+			if cfg.LargeResponseThreshold > 0 {
+				checkResponseSize(resp, cfg.LargeResponseThreshold, reqID.(string))
+			}
+			if cfg.LogBodyPreview > 0 {
+				transactionFrom(resp.Request.Context()).bodyPreview = bodyPreview(resp, cfg.LogBodyPreview, reqID.(string))
+			}
+			if tx := transactionFrom(resp.Request.Context()); tx.capture && tx.skippedByResponseRule(resp.Header) {
+				// Drop the request bones held back for this decision
+				tx.capture = false
+				tx.pending = nil
+			}
+			if tx := transactionFrom(resp.Request.Context()); tx.capture {
+				sp.writeResponseToFile(resp, reqID.(string))
+				if cfg.StrictCapture && tx.captureFailed {
+					return errCaptureFailed
+				}
+				if cfg.GoTestExport {
+					writeGoTest(resp, tx, reqID.(string))
+				}
+			}
+			if bonesDB != nil {
+				bonesDB.insert(resp, transactionFrom(resp.Request.Context()), reqID.(string))
+			}
+			if len(cfg.OpenAPIExamples) > 0 {
+				recordOpenAPIExample(resp, transactionFrom(resp.Request.Context()), reqID.(string))
+			}
+			if len(cfg.RecordReplay) > 0 {
+				recordResponse(resp, transactionFrom(resp.Request.Context()), reqID.(string))
+			}
+			if cfg.DiffReqResp {
+				diffBodies(resp, transactionFrom(resp.Request.Context()), reqID.(string))
+			}
+			if tx := transactionFrom(resp.Request.Context()); tx.primaryResult != nil {
+				body := tx.responseBody
+				if body == nil {
+					body = readResponseBody(resp)
+				}
+				tx.primaryResult <- &shadowResult{status: resp.StatusCode, header: resp.Header, body: body}
 			}
 		}
+		// Throttle last so captures above still read the body at full speed
+		if cfg.ThrottleBytesPerSec > 0 && resp.Body != nil {
+			resp.Body = newThrottledReader(resp.Request.Context(), resp.Body, cfg.ThrottleBytesPerSec)
+		}
 		return nil
 	}
 
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		reqID, _ := req.Context().Value(requestIDKey).(string)
+		tx := transactionFrom(req.Context())
+		if responseRule != nil && !tx.forced {
+			// No response, so nothing can carry CaptureIfResponseHeader
+			tx.capture = false
+			tx.pending = nil
+		}
+		sp.writePendingBones(tx, boneFolderFor(http.StatusBadGateway), reqID)
+		if tx.primaryResult != nil {
+			// Nothing to compare against, release the shadow
+			close(tx.primaryResult)
+		}
+		if errors.Is(err, errCaptureFailed) {
+			log.Error().Str("phase", "capture-failed").Str("method", req.Method).Str("url", req.URL.Path).Str("id", reqID).Msg("ERROR capturing transaction, refusing to answer")
+			w.Header().Set("X-Bloodhound-Capture-Failed", "true")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			log.Warn().Str("phase", "rejected").Str("method", req.Method).Int64("contentLength", req.ContentLength).Int64("maxRequestBytes", maxBytesErr.Limit).Str("url", req.URL.Path).Str("remoteAddr", req.RemoteAddr).Str("id", reqID).Msg("Request body too large")
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		class := classifyError(err)
+		if tx.capture {
+			writeErrorBone(req, tx, class, err, reqID)
+		}
+		if errors.Is(err, errUpstreamQueueTimeout) {
+			log.Warn().Str("phase", "upstream-queue").Str("method", req.Method).Str("url", req.URL.Path).Int("maxUpstreamConns", cfg.MaxUpstreamConns).Dur("timeout", cfg.UpstreamQueueTimeout).Str("id", reqID).Msg("No upstream connection slot freed up")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Warn().Str("phase", "deadline-exceeded").Str("method", req.Method).Str("url", req.URL.Path).Dur("timeout", cfg.RequestTimeout).Str("id", reqID).Msg("Request timed out")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		log.Error().Str("phase", "error").Str("method", req.Method).Str("url", req.URL.Path).Str("errorClass", class).Str("id", reqID).Msgf("ERROR proxying request : %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
 	return sp, nil
 }
 
-func (sp *SniffingProxy) sniffRequest(req *http.Request, reqID int64) {
-	log.Info().Str("phase", "request").Str("method", req.Method).Str("url", req.URL.Path).Str("proto", req.Proto).Str("userAgent", req.UserAgent()).Str("remoteAddr", req.RemoteAddr).Int64("id", reqID).Msg("Request")
+// errCaptureFailed fails a StrictCapture transaction whose bones could not
+// be written
+var errCaptureFailed = errors.New("capture failed")
+
+// traceHeader is the header carrying the request ID up and downstream,
+// empty when disabled
+func traceHeader() string {
+	if cfg.InjectTraceHeader == "none" {
+		return ""
+	}
+	return cfg.InjectTraceHeader
 }
 
-func (sp *SniffingProxy) sniffResponse(resp *http.Response, reqID int64) error {
-	log.Info().Str("phase", "response").Str("method", resp.Request.Method).Str("url", resp.Request.URL.Path).Int("statusCode", resp.StatusCode).Str("status", resp.Status).Str("contentLength", resp.Header.Get("Content-Length")).Int64("id", reqID).Msg("Response")
-	return nil
+// newRequestID formats the n-th request's ID according to RequestIDFormat
+func newRequestID(n int64) string {
+	switch cfg.RequestIDFormat {
+	case "uuid":
+		return newUUID()
+	case "timestamp-counter":
+		return fmt.Sprintf("%s-%06d", startTime.Format("20060102150405"), n)
+	default:
+		return fmt.Sprintf("%06d", n)
+	}
 }
 
-func (sp *SniffingProxy) writeRequestToFile(req *http.Request, reqID int64) {
-	dt := time.Now()
-	filename := filepath.Join(cfg.BoneFolder, fmt.Sprintf("%s-%06d-request.txt", dt.Format("20060102-150405"), reqID))
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Error().Msgf("ERROR generating UUID : %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
 
-	// Create a buffer to capture the request dump
-	var buf bytes.Buffer
+// rewritePathPrefix applies StripPathPrefix then AddPathPrefix to a path
+func rewritePathPrefix(path string) string {
+	if prefix := strings.TrimSuffix(cfg.StripPathPrefix, "/"); prefix != "" {
+		if path == prefix {
+			path = "/"
+		} else if strings.HasPrefix(path, prefix+"/") {
+			path = path[len(prefix):]
+		}
+	}
+	if prefix := strings.TrimSuffix(cfg.AddPathPrefix, "/"); prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		path = prefix + path
+	}
+	return path
+}
 
-	// Write request line and headers
-	fmt.Fprintf(&buf, "%s %s %s\n", req.Method, req.RequestURI, req.Proto)
-	fmt.Fprintf(&buf, "Host: %s\n", req.Host)
+// normalizeTrailingSlash adds or strips the trailing slash as configured by
+// TrailingSlash, leaving the root path alone
+func normalizeTrailingSlash(path string) string {
+	if path == "" || path == "/" {
+		return path
+	}
+	switch cfg.TrailingSlash {
+	case "add":
+		if !strings.HasSuffix(path, "/") {
+			return path + "/"
+		}
+	case "strip":
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			return trimmed
+		}
+		return "/"
+	}
+	return path
+}
 
-	// Write all headers
-	for name, values := range req.Header {
-		for _, value := range values {
-			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+// rewritePath applies fn to both the decoded and the escaped form of the
+// URL path so that encoded characters survive the rewrite
+func rewritePath(u *url.URL, fn func(string) string) {
+	if u.RawPath != "" {
+		u.RawPath = fn(u.RawPath)
+	}
+	u.Path = fn(u.Path)
+}
+
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// overrideMethods are the methods a client may switch to via
+// X-HTTP-Method-Override
+var overrideMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// overrideMethod switches req to the method requested in
+// X-HTTP-Method-Override, which ServeHTTP has already validated
+func overrideMethod(req *http.Request) {
+	override := strings.ToUpper(strings.TrimSpace(req.Header.Get(methodOverrideHeader)))
+	if override == "" {
+		return
+	}
+	req.Header.Del(methodOverrideHeader)
+	if override == req.Method {
+		return
+	}
+	reqID, _ := req.Context().Value(requestIDKey).(string)
+	log.Info().Str("phase", "method-override").Str("originalMethod", req.Method).Str("method", override).Str("url", req.URL.Path).Str("id", reqID).Msg("Method overridden")
+	req.Method = override
+}
+
+func (sp *SniffingProxy) sniffRequest(req *http.Request, clientPath string, reqID string) {
+	event := transactionFrom(req.Context()).info().Str("phase", "request").Str("method", req.Method).Str("url", clientPath)
+	if req.URL.Path != clientPath {
+		event = event.Str("upstreamPath", req.URL.Path)
+	}
+	if cfg.LogQuery {
+		event = event.Str("query", logQuery(req.URL.RawQuery))
+	}
+	event = event.Str("reqHash", transactionFrom(req.Context()).requestHash)
+	event = event.Str("proto", req.Proto).Str("userAgent", req.UserAgent()).Str("remoteAddr", req.RemoteAddr)
+	if req.TLS != nil {
+		event = event.Str("alpn", req.TLS.NegotiatedProtocol)
+	}
+	event.Str("id", reqID).Msg("Request")
+}
+
+func (sp *SniffingProxy) sniffResponse(resp *http.Response, reqID string) error {
+	tx := transactionFrom(resp.Request.Context())
+	event := tx.info().Str("phase", "response").Str("method", resp.Request.Method).Str("url", resp.Request.URL.Path).Int("statusCode", resp.StatusCode).Str("status", resp.Status).Str("contentLength", resp.Header.Get("Content-Length"))
+	if tx.upstreamIP != "" {
+		event = event.Str("upstreamIP", tx.upstreamIP)
+	}
+	event.Str("id", reqID).Msg("Response")
+	return nil
+}
+
+// traceUpstreamIP records the remote address of the connection the request
+// is sent on, to tell apart the IPs of a load balanced upstream
+func traceUpstreamIP(req *http.Request) {
+	tx := transactionFrom(req.Context())
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			// WireCapture's dump runs the request over a fake connection
+			// without an address
+			remote := info.Conn.RemoteAddr()
+			if remote == nil {
+				return
+			}
+			addr := remote.String()
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			tx.upstreamIP = addr
+		},
+	}
+	*req = *req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// writeHeaders dumps a header map into a bone, limited to CaptureHeaders
+// when that allowlist is set. Names are sorted and NormalizeHeaders values
+// replaced so bones of the same exchange are byte for byte identical.
+func writeHeaders(buf *bytes.Buffer, header http.Header) {
+	for _, name := range sortedKeys(header) {
+		canonical := http.CanonicalHeaderKey(name)
+		if captureHeaders != nil && !captureHeaders[canonical] {
+			continue
+		}
+		for _, value := range header[name] {
+			if normalizeHeaders[canonical] {
+				value = "<normalized>"
+			}
+			fmt.Fprintf(buf, "%s: %s\n", headerName(name), value)
 		}
 	}
+}
 
-	fmt.Fprintf(&buf, "\n") // Empty line between headers and body
+// writeRequestCookies breaks the Cookie header out into one line per cookie
+func writeRequestCookies(buf *bytes.Buffer, req *http.Request) {
+	cookies := req.Cookies()
+	if len(cookies) == 0 || (captureHeaders != nil && !captureHeaders["Cookie"]) {
+		return
+	}
+	fmt.Fprintf(buf, "--- cookies ---\n")
+	for _, cookie := range cookies {
+		fmt.Fprintf(buf, "%s=%s\n", cookie.Name, cookie.Value)
+	}
+}
 
-	// Read and write body if present
-	if req.Body != nil {
-		bodyBytes, err := io.ReadAll(req.Body)
-		if err == nil {
-			buf.Write(bodyBytes)
-			// Restore the body for the actual request
-			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+// writeResponseCookies lists each Set-Cookie with its attributes spelled out
+func writeResponseCookies(buf *bytes.Buffer, resp *http.Response) {
+	cookies := resp.Cookies()
+	if len(cookies) == 0 || (captureHeaders != nil && !captureHeaders["Set-Cookie"]) {
+		return
+	}
+	fmt.Fprintf(buf, "--- cookies ---\n")
+	for _, cookie := range cookies {
+		attrs := []string{cookie.Name + "=" + cookie.Value}
+		if cookie.Domain != "" {
+			attrs = append(attrs, "domain="+cookie.Domain)
+		}
+		if cookie.Path != "" {
+			attrs = append(attrs, "path="+cookie.Path)
+		}
+		if !cookie.Expires.IsZero() {
+			attrs = append(attrs, "expires="+cookie.Expires.UTC().Format(time.RFC3339))
 		}
+		if cookie.MaxAge != 0 {
+			attrs = append(attrs, "max-age="+strconv.Itoa(cookie.MaxAge))
+		}
+		if cookie.Secure {
+			attrs = append(attrs, "secure")
+		}
+		if cookie.HttpOnly {
+			attrs = append(attrs, "httponly")
+		}
+		switch cookie.SameSite {
+		case http.SameSiteLaxMode:
+			attrs = append(attrs, "samesite=lax")
+		case http.SameSiteStrictMode:
+			attrs = append(attrs, "samesite=strict")
+		case http.SameSiteNoneMode:
+			attrs = append(attrs, "samesite=none")
+		}
+		fmt.Fprintf(buf, "%s\n", strings.Join(attrs, "; "))
 	}
+}
 
-	// Write to file
-	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
-		log.Error().Int64("id", reqID).Msgf("ERROR writing request file : %v", err)
+// writeTrailers lists the trailers received after a response body
+func writeTrailers(buf *bytes.Buffer, trailer http.Header) {
+	if len(trailer) == 0 {
+		return
 	}
+	fmt.Fprintf(buf, "--- trailers ---\n")
+	writeHeaders(buf, trailer)
 }
 
-func (sp *SniffingProxy) writeResponseToFile(resp *http.Response, reqID int64) {
-	dt := time.Now()
-	filename := filepath.Join(cfg.BoneFolder, fmt.Sprintf("%s-%06d-response.txt", dt.Format("20060102-150405"), reqID))
+// headerName applies HeaderCase to a header name written to a bone. The
+// server has already canonicalized names parsed off the wire, so original
+// is the name as the header map holds it.
+func headerName(name string) string {
+	switch cfg.HeaderCase {
+	case "canonical":
+		return http.CanonicalHeaderKey(name)
+	case "lower":
+		return strings.ToLower(name)
+	default:
+		return name
+	}
+}
 
-	// Create a buffer to capture the response dump
-	var buf bytes.Buffer
+// headerSet builds a lookup of canonical header names, nil when empty
+func headerSet(names []string) map[string]bool {
+	var set map[string]bool
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			set[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return set
+}
 
-	// Write status line
-	fmt.Fprintf(&buf, "%s %s\n", resp.Proto, resp.Status)
+// genericContentTypes are declared types that say little about the body and
+// are worth double checking against the actual bytes
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
 
-	// Write all headers
-	for name, values := range resp.Header {
-		for _, value := range values {
-			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+func (sp *SniffingProxy) detectResponseType(resp *http.Response, reqID string) {
+	declared := resp.Header.Get("Content-Type")
+	declaredType, _, _ := mime.ParseMediaType(declared)
+	if !genericContentTypes[declaredType] || resp.Body == nil {
+		return
+	}
+
+	// DetectContentType only looks at the first 512 bytes
+	prefix := peekBody(resp, 512, reqID)
+	if len(prefix) == 0 {
+		return
+	}
+
+	detected := detectContentType(prefix)
+	detectedType, _, _ := mime.ParseMediaType(detected)
+	if detectedType == declaredType {
+		return
+	}
+	log.Info().Str("phase", "content-type").Str("url", resp.Request.URL.Path).Str("declared", declared).Str("detected", detected).Bool("fixed", cfg.FixContentType).Str("id", reqID).Msg("Content type mismatch")
+	if cfg.FixContentType {
+		resp.Header.Set("Content-Type", detected)
+	}
+}
+
+// detectContentType wraps http.DetectContentType, which has no notion of
+// JSON and reports it as text/plain
+func detectContentType(prefix []byte) string {
+	detected := http.DetectContentType(prefix)
+	if strings.HasPrefix(detected, "text/plain") {
+		trimmed := bytes.TrimSpace(prefix)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return "application/json"
 		}
 	}
+	return detected
+}
 
-	fmt.Fprintf(&buf, "\n") // Empty line between headers and body
+// peekBody reads up to n bytes from the start of the response body and puts
+// them back in front of the rest of it
+func peekBody(resp *http.Response, n int, reqID string) []byte {
+	prefix := make([]byte, n)
+	read, err := io.ReadFull(resp.Body, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Error().Str("id", reqID).Msgf("ERROR peeking at response body : %v", err)
+	}
+	prefix = prefix[:read]
+	resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body), Closer: resp.Body}
+	return prefix
+}
 
-	// Read and write body if present
-	if resp.Body != nil {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err == nil {
-			buf.Write(bodyBytes)
-			// Restore the body for the client
-			resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+// checkResponseSize warns about responses larger than threshold, using
+// Content-Length when sent or else counting the body as it is read
+func checkResponseSize(resp *http.Response, threshold int64, reqID string) {
+	if resp.ContentLength < 0 {
+		if resp.Body != nil {
+			resp.Body = &sizeWatchReader{ReadCloser: resp.Body, resp: resp, threshold: threshold, reqID: reqID}
 		}
+		return
 	}
+	if resp.ContentLength > threshold {
+		logLargeResponse(resp, resp.ContentLength, true, threshold, reqID)
+	}
+}
 
-	// Write to file
-	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
-		log.Error().Int64("id", reqID).Msgf("ERROR writing response file : %v", err)
+func logLargeResponse(resp *http.Response, size int64, known bool, threshold int64, reqID string) {
+	log.Warn().Bool("largeResponse", true).Str("method", resp.Request.Method).Str("url", resp.Request.URL.Path).Int64("size", size).Bool("sizeIsMinimum", !known).Int64("threshold", threshold).Str("id", reqID).Msg("Large response")
+}
+
+// sizeWatchReader counts a response body of unknown length as it is read
+// and warns once it passes the LargeResponseThreshold
+type sizeWatchReader struct {
+	io.ReadCloser
+	resp      *http.Response
+	threshold int64
+	reqID     string
+	n         int64
+	warned    bool
+}
+
+func (sw *sizeWatchReader) Read(p []byte) (int, error) {
+	n, err := sw.ReadCloser.Read(p)
+	sw.n += int64(n)
+	if sw.n > sw.threshold && !sw.warned {
+		sw.warned = true
+		logLargeResponse(sw.resp, sw.n, false, sw.threshold, sw.reqID)
 	}
+	return n, err
 }
 
-func (sp *SniffingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	reqID := atomic.AddInt64(&requestIdCounter, 1)
+// isTextual reports whether a Content-Type is safe to show as text
+func isTextual(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded", "application/graphql":
+		return true
+	}
+	return false
+}
 
-	// Add reqID to context
-	ctx := context.WithValue(r.Context(), requestIDKey, reqID)
-	r = r.WithContext(ctx)
+// bodyPreview captures the start of textual, unencoded response bodies for
+// the completion log line
+func bodyPreview(resp *http.Response, n int, reqID string) string {
+	if resp.Body == nil || !isTextual(resp.Header.Get("Content-Type")) {
+		return ""
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return ""
+	}
+	return escapeNonPrintable(peekBody(resp, n, reqID))
+}
 
-	// Wrap the response writer to capture status code
-	wrappedWriter := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-	sp.proxy.ServeHTTP(wrappedWriter, r)
+// escapeNonPrintable leaves printable text alone but Go-escapes control
+// characters and invalid UTF-8
+func escapeNonPrintable(b []byte) string {
+	var sb strings.Builder
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&sb, "\\x%02x", b[0])
+		case unicode.IsPrint(r):
+			sb.WriteRune(r)
+		default:
+			quoted := strconv.QuoteRune(r)
+			sb.WriteString(quoted[1 : len(quoted)-1])
+		}
+		b = b[size:]
+	}
+	return sb.String()
+}
 
-	duration := time.Since(start)
-	log.Info().Str("phase", "completed").Str("method", r.Method).Str("url", r.URL.Path).Int("statusCode", wrappedWriter.statusCode).Dur("duration", duration).Int64("id", reqID).Msg("Completed")
+// multiReadCloser reads from Reader but closes the original body
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
-// responseWriter wraps http.ResponseWriter to capture the status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
+// boneFilename names a bone, name being its kind and extension such as
+// request.txt
+func boneFilename(folder string, dt time.Time, reqID string, name string) string {
+	if cfg.BoneRotate > 0 {
+		return filepath.Join(folder, fmt.Sprintf("bone-%d-%s", rotationSlot(reqID), name))
+	}
+	return filepath.Join(folder, fmt.Sprintf("%s-%s-%s", dt.Format("20060102-150405"), reqID, name))
 }
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// boneFolderFor picks the folder for a transaction with the given status
+func boneFolderFor(statusCode int) string {
+	if len(cfg.BoneFolderErrors) > 0 && statusCode >= 400 {
+		return cfg.BoneFolderErrors
+	}
+	return cfg.BoneFolder
 }
 
-func main() {
-	var err error
-	cfg, err = env.ParseAs[Config]()
+// storeRequestBone writes a request bone straight to BoneFolder or, when
+// the folder depends on the response status, holds it in the transaction
+func (sp *SniffingProxy) storeRequestBone(req *http.Request, dt time.Time, reqID string, name string, data []byte) {
+	if len(cfg.BoneFolderErrors) > 0 || responseRule != nil {
+		tx := transactionFrom(req.Context())
+		tx.pending = append(tx.pending, pendingBone{name: name, time: dt, data: data})
+		return
+	}
+	if !writeBone(boneFilename(cfg.BoneFolder, dt, reqID, name), data, reqID) {
+		transactionFrom(req.Context()).captureFailed = true
+	}
+}
+
+// bufferBodies reports whether bodies must be kept on the transaction even
+// for requests that aren't captured to bone files
+func (sp *SniffingProxy) bufferBodies() bool {
+	return bonesDB != nil || len(cfg.OpenAPIExamples) > 0 || sp.shadow != nil || cfg.DiffReqResp
+}
+
+// readRequestBody buffers the request body and restores it for the
+// actual request
+func readRequestBody(req *http.Request) []byte {
+	if req.Body == nil {
+		return nil
+	}
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		// Forward the same failure, e.g. a body over MaxRequestBytes
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), errorReader{err}))
+		return nil
+	}
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	return bodyBytes
+}
+
+// readResponseBody buffers the response body and restores the original,
+// still encoded, bytes for the client
+func readResponseBody(resp *http.Response) []byte {
+	if resp.Body == nil || isStreamType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	bodyBytes, err := io.ReadAll(resp.Body)
+	// The copy below replaces it, closing lets the transport reuse the
+	// connection and MaxUpstreamConns free the slot
+	resp.Body.Close()
 	if err != nil {
-		log.Fatal().Msgf("error reading ENV config: %v", err)
+		// Keep what did arrive, e.g. a body shorter than its Content-Length,
+		// and let the client see the same failure after it
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), errorReader{err}))
+		return bodyBytes
 	}
+	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	return bodyBytes
+}
 
-	// Create the Sniffing proxy
-	proxy, err := NewSniffingProxy(cfg.TargetUrl)
+// errorReader fails every read with err
+type errorReader struct {
+	err error
+}
+
+func (er errorReader) Read([]byte) (int, error) {
+	return 0, er.err
+}
+
+// allowedRequestType reports whether a request body of contentType may be
+// forwarded, AllowedRequestTypes entries may end in /* to allow a family
+func allowedRequestType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		log.Fatal().Msgf("failed to create proxy: %v", err)
+		return false
 	}
+	for _, allowed := range cfg.AllowedRequestTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Create HTTP server
-	server := &http.Server{
-		Addr:    cfg.ListenAddr,
-		Handler: proxy,
+// isStreamType reports whether responses of contentType are passed through
+// without being buffered, as configured by NoBodyCaptureTypes
+func isStreamType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return false
+	}
+	for _, prefix := range cfg.NoBodyCaptureTypes {
+		prefix = strings.ToLower(strings.TrimSpace(prefix))
+		if prefix != "" && prefix != "none" && strings.HasPrefix(contentType, prefix) {
+			return true
+		}
 	}
+	return false
+}
 
-	log.Warn().Msgf("starting reverse proxy on %s, proxying to %s", cfg.ListenAddr, cfg.TargetUrl)
-	if len(cfg.BoneFolder) > 0 {
-		log.Warn().Msgf("sniffed bones will be written to %s", cfg.BoneFolder)
+// writePendingBones writes the bones held back by storeRequestBone
+func (sp *SniffingProxy) writePendingBones(tx *transaction, folder string, reqID string) {
+	for _, bone := range tx.pending {
+		if !writeBone(boneFilename(folder, bone.time, reqID, bone.name), bone.data, reqID) {
+			tx.captureFailed = true
+		}
+	}
+	tx.pending = nil
+}
+
+func writeBone(filename string, data []byte, reqID string) bool {
+	return storeBone(filename, data, reqID, false)
+}
 
+// storeBone hands a bone file to the writers, or holds it in the capture
+// ring when RingSize is set. With hook the bone hook runs once it is written.
+func storeBone(filename string, data []byte, reqID string, hook bool) bool {
+	return storeBoneJob(boneWrite{filename: filename, data: data, reqID: reqID, hook: hook})
+}
+
+// storeBoneJob is storeBone for a prepared boneWrite
+func storeBoneJob(job boneWrite) bool {
+	if cfg.CaptureSlowerThan > 0 && heldBone(job) {
+		return true
 	}
-	// Start the server
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal().Msgf("Server failed to start: %v", err)
+	if ring != nil {
+		ring.add(job)
+		return true
+	}
+	return queueBone(job)
+}
+
+// storedBody records that the bone filename, now written, holds the body
+// identified by bodyHash for DedupBodies
+func storedBody(filename, bodyHash string) {
+	seenBodies.Lock()
+	defer seenBodies.Unlock()
+	if _, seen := seenBodies.files[bodyHash]; !seen {
+		seenBodies.files[bodyHash] = filepath.Base(filename)
+	}
+}
+
+func saveBone(filename string, data []byte, reqID string) bool {
+	if cfg.BoneRotate > 0 {
+		slotOwners.Lock()
+		defer slotOwners.Unlock()
+		if !claimSlot(reqID) {
+			log.Warn().Str("phase", "rotate").Str("file", filepath.Base(filename)).Str("id", reqID).Msg("Bone slot reused by a later request, dropping bone")
+			return false
+		}
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR writing bone file %s : %v", filepath.Base(filename), err)
+		return false
+	}
+	return true
+}
+
+func (sp *SniffingProxy) writeRequestToFile(req *http.Request, reqID string) {
+	dt := time.Now()
+
+	// Create a buffer to capture the request dump
+	var buf bytes.Buffer
+	writeBoneMetadata(&buf, req, reqID, false)
+
+	// Write request line and headers
+	fmt.Fprintf(&buf, "%s %s %s\n", req.Method, req.URL.RequestURI(), req.Proto)
+	fmt.Fprintf(&buf, "%s: %s\n", headerName("Host"), req.Host)
+
+	// Write all headers
+	writeHeaders(&buf, req.Header)
+	writeRequestCookies(&buf, req)
+
+	fmt.Fprintf(&buf, "X-Bloodhound-Request-Hash: %s\n", transactionFrom(req.Context()).requestHash)
+
+	// The server strips Transfer-Encoding from the headers, the body below
+	// is already de-chunked
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		fmt.Fprintf(&buf, "X-Bloodhound-Was-Chunked: true\n")
+	}
+
+	// HeadersOnly never reads the body, it goes upstream untouched
+	if !cfg.HeadersOnly {
+		writeRequestBody(&buf, req, reqID)
+	}
+
+	// Write to file
+	sp.storeRequestBone(req, dt, reqID, "request.txt", buf.Bytes())
+
+	if cfg.RawCapture {
+		sp.writeRawRequest(req, dt, reqID)
+	}
+}
+
+// writeRequestBody reads the request body, restoring it for the upstream,
+// and writes its bone markers and captured copy
+func writeRequestBody(buf *bytes.Buffer, req *http.Request, reqID string) {
+	// Read body if present, the original bytes are forwarded upstream
+	bodyBytes := readRequestBody(req)
+	transactionFrom(req.Context()).requestBody = bodyBytes
+
+	// Store a readable copy of compressed uploads
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "" && len(bodyBytes) > 0 {
+		bodyBytes = writeDecoded(buf, encoding, bodyBytes, "request", reqID)
+	}
+
+	bodyBytes = writeRedacted(buf, bodyBytes, req.Header.Get("Content-Type"), reqID)
+
+	if encodesBody(bodyBytes) {
+		fmt.Fprintf(buf, "X-Bloodhound-Body-Encoding: %s\n", cfg.BoneBodyEncoding)
+	}
+
+	fmt.Fprintf(buf, "\n") // Empty line between headers and body
+	writeCapturedBody(buf, bodyBytes)
+}
+
+// writeRawRequest stores the request in HTTP/1.1 wire format, ready to be
+// sent again as is with -send-raw. It is rebuilt from the parsed request, so
+// the headers are canonicalized and sorted rather than as the client sent
+// them.
+func (sp *SniffingProxy) writeRawRequest(req *http.Request, dt time.Time, reqID string) {
+	// DumpRequest prefers RequestURI, which still holds the client's URI
+	// rather than the rewritten upstream one
+	out := *req
+	out.RequestURI = ""
+	raw, err := httputil.DumpRequest(&out, !cfg.HeadersOnly)
+	req.Body = out.Body
+	if err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR dumping raw request : %v", err)
+		return
+	}
+	sp.storeRequestBone(req, dt, reqID, "request.raw", raw)
+}
+
+func (sp *SniffingProxy) writeResponseToFile(resp *http.Response, reqID string) {
+	dt := time.Now()
+	folder := boneFolderFor(resp.StatusCode)
+	sp.writePendingBones(transactionFrom(resp.Request.Context()), folder, reqID)
+	filename := boneFilename(folder, dt, reqID, "response.txt")
+
+	// Create a buffer to capture the response dump
+	var buf bytes.Buffer
+	writeBoneMetadata(&buf, resp.Request, reqID, true)
+
+	// Write status line
+	fmt.Fprintf(&buf, "%s %s\n", resp.Proto, resp.Status)
+
+	// Write all headers
+	writeHeaders(&buf, resp.Header)
+	writeResponseCookies(&buf, resp)
+
+	if upstreamIP := transactionFrom(resp.Request.Context()).upstreamIP; upstreamIP != "" {
+		fmt.Fprintf(&buf, "X-Bloodhound-Upstream-IP: %s\n", upstreamIP)
+	}
+
+	// HeadersOnly never reads the body, it reaches the client untouched
+	var bodyHash string
+	if cfg.HeadersOnly {
+		writeClientAborted(&buf, resp, reqID)
+	} else {
+		bodyHash = writeResponseBody(&buf, resp, reqID)
+	}
+
+	// Write to file
+	if !storeBoneJob(boneWrite{filename: filename, data: buf.Bytes(), reqID: reqID, hook: true, bodyHash: bodyHash}) {
+		transactionFrom(resp.Request.Context()).captureFailed = true
+	}
+}
+
+// writeClientAborted marks the response bone of a client that went away
+// under CaptureOnClientAbort
+func writeClientAborted(buf *bytes.Buffer, resp *http.Response, reqID string) {
+	if clientCtx, ok := resp.Request.Context().Value(clientContextKey).(context.Context); ok && clientCtx.Err() != nil {
+		log.Warn().Str("phase", "client-aborted").Str("url", resp.Request.URL.Path).Str("id", reqID).Msg("Client went away, capturing upstream response anyway")
+		fmt.Fprintf(buf, "X-Bloodhound-Client-Aborted: true\n")
+	}
+}
+
+// writeResponseBody reads the response body, restoring it for the client,
+// and writes its bone markers, trailers and captured copy. It returns the
+// SHA-256 of a body DedupBodies has not seen stored yet.
+func writeResponseBody(buf *bytes.Buffer, resp *http.Response, reqID string) string {
+	// Read body if present
+	bodyBytes := readResponseBody(resp)
+	transactionFrom(resp.Request.Context()).responseBody = bodyBytes
+	// Checked once the body is in, the client may leave while it transfers
+	writeClientAborted(buf, resp, reqID)
+
+	if declared := resp.Header.Get("Content-Length"); declared != "" && resp.Request.Method != http.MethodHead && !isStreamType(resp.Header.Get("Content-Type")) {
+		if length, err := strconv.ParseInt(declared, 10, 64); err == nil && length != int64(len(bodyBytes)) {
+			log.Warn().Str("phase", "length-mismatch").Str("url", resp.Request.URL.Path).Int64("contentLength", length).Int("bodyBytes", len(bodyBytes)).Str("id", reqID).Msg("Response body length differs from Content-Length")
+			fmt.Fprintf(buf, "X-Bloodhound-Length-Mismatch: declared %d, received %d\n", length, len(bodyBytes))
+		}
+	}
+
+	// Store a readable copy of compressed bodies
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && len(bodyBytes) > 0 {
+		bodyBytes = writeDecoded(buf, encoding, bodyBytes, "response", reqID)
+	}
+
+	bodyBytes = writeRedacted(buf, bodyBytes, resp.Header.Get("Content-Type"), reqID)
+
+	// marker replaces bodies that are not stored
+	var marker string
+
+	// Point repeated bodies at the first bone that stored them, bodies only
+	// count as stored once their bone is written
+	var bodyHash string
+	if cfg.DedupBodies && len(bodyBytes) > 0 && inCaptureRange(len(bodyBytes)) {
+		sum := sha256.Sum256(bodyBytes)
+		bodyHash = hex.EncodeToString(sum[:])
+		seenBodies.Lock()
+		original, seen := seenBodies.files[bodyHash]
+		seenBodies.Unlock()
+
+		fmt.Fprintf(buf, "X-Bloodhound-Body-SHA256: %s\n", bodyHash)
+		if seen {
+			fmt.Fprintf(buf, "X-Bloodhound-Duplicate-Of: %s\n", original)
+			marker = fmt.Sprintf("[duplicate body, see %s]\n", original)
+		}
+	}
+
+	// Content-Length of a HEAD describes the GET body that was never sent
+	switch {
+	case resp.Request.Method == http.MethodHead:
+		marker = "[body suppressed: HEAD request]\n"
+	case isStreamType(resp.Header.Get("Content-Type")):
+		marker = "[stream not captured]\n"
+	}
+	if marker == "" && encodesBody(bodyBytes) {
+		fmt.Fprintf(buf, "X-Bloodhound-Body-Encoding: %s\n", cfg.BoneBodyEncoding)
+	}
+
+	// Trailers only hold their values once the body was read above
+	writeTrailers(buf, resp.Trailer)
+
+	fmt.Fprintf(buf, "\n") // Empty line between headers and body
+	if marker != "" {
+		buf.WriteString(marker)
+		return ""
+	}
+	writeCapturedBody(buf, bodyBytes)
+	return bodyHash
+}
+
+func queueBoneHook(filename string, reqID string) {
+	if boneHookQueue != nil {
+		select {
+		case boneHookQueue <- filename:
+		default:
+			log.Warn().Str("id", reqID).Str("file", filename).Msg("bone hook queue full, skipping hook")
+		}
+	}
+}
+
+// writeRedacted masks RedactJSONFields in a bone body, marking the bone when
+// any field was masked
+func writeRedacted(buf *bytes.Buffer, body []byte, contentType string, reqID string) []byte {
+	body, masked := redactJSON(body, contentType, reqID)
+	if masked > 0 {
+		fmt.Fprintf(buf, "X-Bloodhound-Redacted-Fields: %d\n", masked)
+	}
+	return body
+}
+
+// inCaptureRange reports whether a body of size bytes falls within
+// MinBodyCapture and MaxBodyCapture
+func inCaptureRange(size int) bool {
+	return size >= cfg.MinBodyCapture && (cfg.MaxBodyCapture <= 0 || size <= cfg.MaxBodyCapture)
+}
+
+// elidesBody reports whether a body of size bytes is over MaxBodyCapture
+// but still captured as its first and last BodyHeadTailBytes
+func elidesBody(size int) bool {
+	return cfg.BodyHeadTailBytes > 0 && cfg.MaxBodyCapture > 0 && size > cfg.MaxBodyCapture && size > 2*cfg.BodyHeadTailBytes
+}
+
+// writeCapturedBody writes body to a bone, its head and tail when it is
+// elided, or a marker when its size is outside the capture range
+func writeCapturedBody(buf *bytes.Buffer, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	if elidesBody(len(body)) {
+		n := cfg.BodyHeadTailBytes
+		writeEncodedBody(buf, body[:n])
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(buf, "[... %d bytes elided ...]\n", len(body)-2*n)
+		writeEncodedBody(buf, body[len(body)-n:])
+		return
+	}
+	if !inCaptureRange(len(body)) {
+		fmt.Fprintf(buf, "[body size %d outside capture range]\n", len(body))
+		return
+	}
+	writeEncodedBody(buf, body)
+}
+
+// writeEncodedBody writes body to a bone with BoneBodyEncoding
+func writeEncodedBody(buf *bytes.Buffer, body []byte) {
+	switch cfg.BoneBodyEncoding {
+	case "base64":
+		fmt.Fprintf(buf, "%s\n", base64.StdEncoding.EncodeToString(body))
+	case "quoted":
+		fmt.Fprintf(buf, "%s\n", strconv.Quote(string(body)))
+	default:
+		buf.Write(body)
+	}
+}
+
+// encodesBody reports whether writeCapturedBody stores body encoded with
+// BoneBodyEncoding
+func encodesBody(body []byte) bool {
+	return cfg.BoneBodyEncoding != "raw" && len(body) > 0 && (inCaptureRange(len(body)) || elidesBody(len(body)))
+}
+
+// maxDecodedBytes caps how far decodeBody inflates a body, so a small
+// compression bomb can't exhaust memory
+const maxDecodedBytes = 32 << 20
+
+// errDecodedTruncated is returned with the first maxDecodedBytes of a body
+// that inflates past them
+var errDecodedTruncated = fmt.Errorf("decoded body exceeds %d bytes", maxDecodedBytes)
+
+// writeDecoded returns the decoded copy of a compressed body for a bone and
+// marks the bone accordingly, or the body as is when it can't be decoded
+func writeDecoded(buf *bytes.Buffer, encoding string, body []byte, kind string, reqID string) []byte {
+	decoded, err := decodeBody(encoding, body)
+	if err != nil && !errors.Is(err, errDecodedTruncated) {
+		log.Warn().Str("id", reqID).Str("encoding", encoding).Msgf("unable to decode %s body : %v", kind, err)
+		return body
+	}
+	fmt.Fprintf(buf, "X-Bloodhound-Decoded: %s\n", encoding)
+	if err != nil {
+		log.Warn().Str("id", reqID).Str("encoding", encoding).Int("maxDecodedBytes", maxDecodedBytes).Msgf("%s body decodes past the limit, capturing it truncated", kind)
+		fmt.Fprintf(buf, "X-Bloodhound-Decoded-Truncated: %d\n", maxDecodedBytes)
+	}
+	return decoded
+}
+
+// decodeBody undoes a Content-Encoding so captured bodies can be read. Past
+// maxDecodedBytes it returns what was decoded with errDecodedTruncated.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	case "deflate":
+		// Most servers send zlib wrapped deflate, but some send it raw
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			reader = zr
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxDecodedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxDecodedBytes {
+		return decoded[:maxDecodedBytes], errDecodedTruncated
+	}
+	return decoded, nil
+}
+
+// startBoneHooks launches a fixed pool of workers that run cfg.BoneHook
+// against every response bone, so a slow hook never blocks the proxy
+func startBoneHooks() {
+	workers := cfg.BoneHookWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	boneHookQueue = make(chan string, workers*16)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for filename := range boneHookQueue {
+				runBoneHook(filename)
+			}
+		}()
+	}
+}
+
+func runBoneHook(filename string) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(cfg.BoneHook, filename)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	event := log.Info()
+	if err != nil {
+		event = log.Warn().Err(err)
+	}
+	event.Str("phase", "hook").Str("hook", cfg.BoneHook).Str("file", filename).Str("stdout", stdout.String()).Str("stderr", stderr.String()).Dur("duration", time.Since(start)).Msg("Bone hook")
+}
+
+func (sp *SniffingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if draining.Load() && r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "close")
+	}
+
+	if strings.HasPrefix(r.URL.Path, adminPrefix) && sp.serveAdmin(w, r) {
+		return
+	}
+	// Infra probes are answered here and kept out of logs and stats
+	if localPaths != nil && serveLocal(w, r) {
+		return
+	}
+
+	if cfg.MaxURLLength > 0 {
+		if urlLength := len(r.URL.String()); urlLength > cfg.MaxURLLength {
+			log.Warn().Str("phase", "rejected").Str("method", r.Method).Int("urlLength", urlLength).Int("maxURLLength", cfg.MaxURLLength).Str("remoteAddr", r.RemoteAddr).Msg("URL too long")
+			http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+			return
+		}
+	}
+
+	if cfg.MaxRequestBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > cfg.MaxRequestBytes {
+			log.Warn().Str("phase", "rejected").Str("method", r.Method).Int64("contentLength", r.ContentLength).Int64("maxRequestBytes", cfg.MaxRequestBytes).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Request body too large")
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Bodies without a Content-Length fail once they cross the limit
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxRequestBytes)
+	}
+
+	if cfg.HonorMethodOverride {
+		if override := strings.ToUpper(strings.TrimSpace(r.Header.Get(methodOverrideHeader))); override != "" && !overrideMethods[override] {
+			log.Warn().Str("phase", "rejected").Str("method", r.Method).Str("override", override).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Invalid method override")
+			http.Error(w, "invalid "+methodOverrideHeader, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(cfg.AllowedRequestTypes) > 0 && r.Body != nil && r.Body != http.NoBody && !allowedRequestType(r.Header.Get("Content-Type")) {
+		log.Warn().Str("phase", "rejected").Str("method", r.Method).Str("contentType", r.Header.Get("Content-Type")).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Request content type not allowed")
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if sp.globalLimiter != nil && !sp.globalLimiter.Allow() {
+		log.Warn().Str("phase", "global-throttle").Str("method", r.Method).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Msg("Global rate limit exceeded")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(sp.globalLimiter.Limit())))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if route := sp.matchRouteRateLimit(r); route != nil {
+		if !route.limiters.allow(w, r) {
+			return
+		}
+	} else if sp.limiters != nil && !sp.limiters.allow(w, r) {
+		return
+	}
+
+	if len(cfg.CORSOrigin) > 0 && isPreflight(r) {
+		answerPreflight(w, r)
+		return
+	}
+
+	reqNum := atomic.AddInt64(&requestIdCounter, 1)
+	reqID := newRequestID(reqNum)
+
+	// Add reqID and the transaction state to context
+	tx := &transaction{start: start, unsampled: !logSampled(reqNum)}
+	tx.capture = sp.shouldCapture(r, tx, reqID)
+	// Forced captures are written however fast they are
+	held := tx.capture && !tx.forced && cfg.CaptureSlowerThan > 0
+	if held {
+		holdBones(reqID)
+	}
+	wrappedWriter := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	var bodyCounter *countingReader
+	// Deferred, a client going away mid-body makes ReverseProxy panic with
+	// http.ErrAbortHandler and the request must still be accounted for
+	defer func() { sp.finish(r, tx, reqID, wrappedWriter, bodyCounter, held) }()
+	if len(cfg.CaptureTriggerHeader) > 0 {
+		// Only meant for us, never forwarded upstream
+		r.Header.Del(cfg.CaptureTriggerHeader)
+	}
+	ctx := context.WithValue(r.Context(), requestIDKey, reqID)
+	ctx = context.WithValue(ctx, transactionKey, tx)
+	if cfg.CaptureOnClientAbort {
+		// Let the upstream call run to completion even if the client goes
+		// away, keeping the client context around to notice that it did
+		ctx = context.WithValue(context.WithoutCancel(ctx), clientContextKey, r.Context())
+	}
+	if cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RequestTimeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+	if traceHeader() != "" {
+		w.Header().Set(traceHeader(), reqID)
+	}
+	if len(cfg.SessionCookie) > 0 {
+		tx.session = sessionID(w, r, reqID)
+	}
+
+	// Count the request body bytes as they are read
+	if r.Body != nil && r.Body != http.NoBody {
+		bodyCounter = &countingReader{ReadCloser: r.Body}
+		r.Body = bodyCounter
+	}
+
+	if cfg.ColdStartDelay > 0 {
+		injectColdStart(r, reqID)
+	}
+	if sp.latency != nil {
+		sp.injectLatency(r, reqID)
+	}
+	if cfg.EchoMode {
+		sp.echo(wrappedWriter, r, reqID)
+	} else if len(cfg.RecordReplay) > 0 && cfg.ReplayMode == "replay" {
+		sp.replay(wrappedWriter, r, reqID)
+	} else if cfg.ForwardProxy && r.Method == http.MethodConnect {
+		sp.tunnel(wrappedWriter, r, reqID)
+	} else {
+		sp.proxy.ServeHTTP(wrappedWriter, r)
+	}
+
+}
+
+// finish does the bookkeeping of a completed request: held bones, the ring,
+// stats, live stream, CloudEvents, the audit log and the completion line
+func (sp *SniffingProxy) finish(r *http.Request, tx *transaction, reqID string, ww *responseWriter, bodyCounter *countingReader, held bool) {
+	duration := time.Since(tx.start)
+	var bytesIn int64
+	if bodyCounter != nil {
+		bytesIn = bodyCounter.n
+	}
+	if held {
+		releaseBones(reqID, duration)
+	}
+	if ring != nil && ww.statusCode >= http.StatusInternalServerError {
+		ring.flush("error")
+	}
+	stats.record(ww.statusCode, bytesIn, ww.bytes, duration)
+	if cfg.UsageInterval > 0 {
+		usage.record(clientIP(r), bytesIn, ww.bytes)
+	}
+	if live != nil || cloudEvents != nil {
+		summary := streamEvent{
+			ID:         reqID,
+			Time:       tx.start,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			URL:        summaryURL(r.URL),
+			StatusCode: ww.statusCode,
+			BytesIn:    bytesIn,
+			BytesOut:   ww.bytes,
+			DurationMs: float64(duration) / float64(time.Millisecond),
+		}
+		if live != nil {
+			live.publish(summary)
+		}
+		if cloudEvents != nil {
+			cloudEvents.publish(summary)
+		}
+	}
+	if audit != nil {
+		audit.append(auditEntry{
+			Time:       tx.start,
+			ID:         reqID,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			URL:        r.URL.RequestURI(),
+			StatusCode: ww.statusCode,
+			BytesIn:    bytesIn,
+			BytesOut:   ww.bytes,
+			Duration:   duration.String(),
+		}, reqID)
+	}
+	event := tx.info()
+	if cfg.SlowThreshold > 0 && duration > cfg.SlowThreshold {
+		event = tx.annotate(log.Warn().Bool("slow", true))
+	}
+	if tx.bodyPreview != "" {
+		event = event.Str("bodyPreview", tx.bodyPreview)
+	}
+	if cfg.LogQuery {
+		event = event.Str("query", logQuery(r.URL.RawQuery))
+	}
+	event.Str("phase", "completed").Str("method", r.Method).Str("url", r.URL.Path).Int("statusCode", ww.statusCode).Dur("duration", duration).Str("id", reqID).Msg("Completed")
+}
+
+// echo answers the request itself with its method, headers and body
+// instead of forwarding it upstream
+func (sp *SniffingProxy) echo(w http.ResponseWriter, r *http.Request, reqID string) {
+	setRequestHash(r, r.URL.Path)
+	sp.sniffRequest(r, r.URL.Path, reqID)
+	if transactionFrom(r.Context()).capture {
+		sp.writeRequestToFile(r, reqID)
+		sp.writePendingBones(transactionFrom(r.Context()), boneFolderFor(http.StatusOK), reqID)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				log.Warn().Str("phase", "rejected").Str("method", r.Method).Int64("contentLength", r.ContentLength).Int64("maxRequestBytes", maxBytesErr.Limit).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Str("id", reqID).Msg("Request body too large")
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Error().Str("id", reqID).Msgf("ERROR reading request body : %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+	}{r.Method, r.RequestURI, r.Header, string(body)})
+}
+
+// checkUpstreamResolves exits when the target host does not exist at all,
+// transient DNS failures are only logged since they may clear up
+func checkUpstreamResolves(target *url.URL) {
+	host := target.Hostname()
+	if host == "" {
+		fatal(exitConfig, "target URL %s has no host", target)
+	}
+	if net.ParseIP(host) != nil {
+		return
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			fatal(exitUpstream, "target host %s does not resolve: %v", host, err)
+		}
+		log.Warn().Msgf("unable to resolve target host %s: %v", host, err)
+	}
+}
+
+// protocolErrorWriter feeds the http.Server error log into zerolog
+type protocolErrorWriter struct{}
+
+func (protocolErrorWriter) Write(p []byte) (int, error) {
+	log.Warn().Str("phase", "protocol-error").Msg(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// responseWriter wraps http.ResponseWriter to capture the status code and
+// the number of body bytes written
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer so
+// ReverseProxy can still flush streamed responses
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func main() {
+	verifyAudit := flag.String("verify-audit", "", "verify the hash chain of an AuditLog file and exit")
+	send := flag.String("send", "", "send the request in a request bone to TargetUrl, print the response and exit")
+	sendRaw := flag.String("send-raw", "", "write the bytes of a request.raw bone to TargetUrl's host as they are, print the response and exit")
+	sendTo := flag.String("to", "", "target URL for -send and -send-raw instead of TargetUrl")
+	exportFolder := flag.String("export-postman", "", "write the request bones in this folder as a Postman collection to the file given as argument and exit")
+	var sendHeaders headerFlags
+	flag.Var(&sendHeaders, "H", "header to override for -send as \"Name: value\", may be repeated")
+	flag.Parse()
+
+	if *verifyAudit != "" {
+		entries, err := verifyAuditLog(*verifyAudit)
+		if err != nil {
+			fatal(1, "audit log %s is invalid after %d entries: %v", *verifyAudit, entries, err)
+		}
+		log.Warn().Msgf("audit log %s is valid, %d entries", *verifyAudit, entries)
+		return
+	}
+
+	var err error
+	cfg, err = env.ParseAs[Config]()
+	if err != nil {
+		fatal(exitConfig, "error reading ENV config: %v", err)
+	}
+	if *exportFolder != "" {
+		if flag.NArg() != 1 {
+			fatal(exitConfig, "usage: -export-postman <bonefolder> <out.json>")
+		}
+		out, err := os.Create(flag.Arg(0))
+		if err != nil {
+			fatal(1, "failed to create %s: %v", flag.Arg(0), err)
+		}
+		if err := exportPostman(out, *exportFolder, cfg.TargetUrl); err != nil {
+			fatal(1, "failed to export %s: %v", *exportFolder, err)
+		}
+		if err := out.Close(); err != nil {
+			fatal(1, "failed to write %s: %v", flag.Arg(0), err)
+		}
+		log.Warn().Msgf("postman collection written to %s", flag.Arg(0))
+		return
+	}
+	if *send != "" {
+		target := cfg.TargetUrl
+		if *sendTo != "" {
+			target = *sendTo
+		}
+		if err := sendBone(os.Stdout, *send, target, sendHeaders); err != nil {
+			fatal(1, "failed to send %s: %v", *send, err)
+		}
+		return
+	}
+	if *sendRaw != "" {
+		target := cfg.TargetUrl
+		if *sendTo != "" {
+			target = *sendTo
+		}
+		if err := sendRawBone(os.Stdout, *sendRaw, target); err != nil {
+			fatal(1, "failed to send %s: %v", *sendRaw, err)
+		}
+		return
+	}
+	switch cfg.RequestIDFormat {
+	case "counter", "uuid", "timestamp-counter":
+	default:
+		fatal(exitConfig, "invalid RequestIDFormat %q, must be counter, uuid or timestamp-counter", cfg.RequestIDFormat)
+	}
+	switch cfg.BoneBodyEncoding {
+	case "raw", "base64", "quoted":
+	default:
+		fatal(exitConfig, "invalid BoneBodyEncoding %q, must be raw, base64 or quoted", cfg.BoneBodyEncoding)
+	}
+	switch cfg.HeaderCase {
+	case "canonical", "lower", "original":
+	default:
+		fatal(exitConfig, "invalid HeaderCase %q, must be canonical, lower or original", cfg.HeaderCase)
+	}
+	if cfg.ReplayMode != "record" && cfg.ReplayMode != "replay" {
+		fatal(exitConfig, "invalid ReplayMode %q, must be record or replay", cfg.ReplayMode)
+	}
+	if cfg.LogSampleRate < 0 || cfg.LogSampleRate > 1 {
+		fatal(exitConfig, "invalid LogSampleRate %v, must be between 0 and 1", cfg.LogSampleRate)
+	}
+	if cfg.RateMode != "reject" && cfg.RateMode != "delay" {
+		fatal(exitConfig, "invalid RateMode %q, must be reject or delay", cfg.RateMode)
+	}
+	if cfg.StrictCapture && (cfg.RingSize > 0 || cfg.CaptureSlowerThan > 0) {
+		fatal(exitConfig, "StrictCapture cannot be combined with RingSize or CaptureSlowerThan, their bones are written after the response")
+	}
+	if cfg.DedupBodies && cfg.BoneRotate > 0 {
+		fatal(exitConfig, "DedupBodies cannot be combined with BoneRotate, the bone holding a body is overwritten by later ones")
+	}
+	if cfg.HeadersOnly && (len(cfg.BoneDB) > 0 || len(cfg.OpenAPIExamples) > 0 || len(cfg.RecordReplay) > 0 || len(cfg.ShadowTarget) > 0 || cfg.LogBodyPreview > 0 || cfg.DiffReqResp) {
+		fatal(exitConfig, "HeadersOnly cannot be combined with BoneDB, OpenAPIExamples, RecordReplay, ShadowTarget, LogBodyPreview or DiffReqResp, they record bodies")
+	}
+	if cfg.HeadersOnly && (cfg.HashIncludeBody || cfg.DetectContentType || cfg.XMLToJSON) {
+		log.Warn().Msg("HeadersOnly never reads bodies, HashIncludeBody, DetectContentType and XMLToJSON are ignored")
+	}
+	if len(cfg.RedactJSONFields) > 0 && !cfg.HeadersOnly && (cfg.RawCapture || cfg.WireCapture) {
+		fatal(exitConfig, "RedactJSONFields cannot be combined with RawCapture or WireCapture unless HeadersOnly is set, their bones keep bodies byte for byte")
+	}
+	if cfg.BoneWriteBackpressure != "block" && cfg.BoneWriteBackpressure != "drop" {
+		fatal(exitConfig, "invalid BoneWriteBackpressure %q, must be block or drop", cfg.BoneWriteBackpressure)
+	}
+	switch cfg.TrailingSlash {
+	case "preserve", "add", "strip":
+	default:
+		fatal(exitConfig, "invalid TrailingSlash %q, must be preserve, add or strip", cfg.TrailingSlash)
+	}
+	captureHeaders = headerSet(cfg.CaptureHeaders)
+	for _, param := range cfg.RedactQueryParams {
+		if param = strings.TrimSpace(param); param != "" {
+			if redactQueryParams == nil {
+				redactQueryParams = make(map[string]bool)
+			}
+			redactQueryParams[param] = true
+		}
+	}
+	for _, field := range cfg.RedactJSONFields {
+		if field = strings.TrimSpace(field); field != "" {
+			redactFields = append(redactFields, strings.Split(field, "."))
+		}
+	}
+	if localPaths, err = parseLocalPaths(cfg.LocalPaths); err != nil {
+		fatal(exitConfig, "invalid LocalPaths: %v", err)
+	}
+	if len(cfg.NormalizeHeaders) != 1 || cfg.NormalizeHeaders[0] != "none" {
+		normalizeHeaders = headerSet(cfg.NormalizeHeaders)
+	}
+	if len(cfg.CaptureOnce) > 0 {
+		if once, err = newCaptureOnce(cfg.CaptureOnce); err != nil {
+			fatal(exitConfig, "invalid CaptureOnce pattern: %v", err)
+		}
+	}
+	if len(cfg.CaptureIfResponseHeader) > 0 {
+		if responseRule, err = parseResponseHeaderRule(cfg.CaptureIfResponseHeader); err != nil {
+			fatal(exitConfig, "invalid CaptureIfResponseHeader %q: %v", cfg.CaptureIfResponseHeader, err)
+		}
+	}
+	if cfg.MaxCaptureRate > 0 {
+		captureLimiter = rate.NewLimiter(rate.Limit(cfg.MaxCaptureRate), max(int(cfg.MaxCaptureRate), 1))
+		go logDroppedCaptures(10 * time.Second)
+		log.Warn().Msgf("capturing at most %g transactions/s", cfg.MaxCaptureRate)
+	}
+
+	if len(cfg.BoneDB) > 0 {
+		if bonesDB, err = openBoneDB(cfg.BoneDB); err != nil {
+			fatal(exitConfig, "failed to open BoneDB %s: %v", cfg.BoneDB, err)
+		}
+		log.Warn().Msgf("transactions will be stored in %s", cfg.BoneDB)
+	}
+	if len(cfg.AuditLog) > 0 {
+		if audit, err = openAuditLog(cfg.AuditLog); err != nil {
+			fatal(exitConfig, "failed to open AuditLog %s: %v", cfg.AuditLog, err)
+		}
+		log.Warn().Msgf("hash chained audit log will be appended to %s", cfg.AuditLog)
+	}
+
+	// Create the Sniffing proxy
+	proxy, err := NewSniffingProxy(cfg.TargetUrl)
+	if err != nil {
+		fatal(exitConfig, "failed to create proxy: %v", err)
+	}
+	replaying := len(cfg.RecordReplay) > 0 && cfg.ReplayMode == "replay"
+	if !replaying {
+		// Replays never contact the upstream, it may well be offline
+		checkUpstreamResolves(proxy.target)
+	}
+
+	// Create HTTP server
+	server := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           proxy,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ErrorLog:          stdlog.New(protocolErrorWriter{}, "", 0),
+		ReadTimeout:       cfg.ServerReadTimeout,
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+
+	log.Warn().Msgf("starting reverse proxy on %s, proxying to %s", cfg.ListenAddr, cfg.TargetUrl)
+	log.Warn().Msgf("server timeouts: read=%s readHeader=%s write=%s idle=%s", cfg.ServerReadTimeout, cfg.ServerReadHeaderTimeout, cfg.ServerWriteTimeout, cfg.ServerIdleTimeout)
+	for _, route := range proxy.routes {
+		log.Warn().Msgf("routing requests with %s: %s to %s", route.header, route.value, route.target)
+	}
+	for _, rule := range proxy.latency {
+		log.Warn().Msgf("delaying requests under %s by %s", rule.prefix, rule.delay)
+	}
+	if len(cfg.ShadowTarget) > 0 {
+		log.Warn().Msgf("mirroring requests to shadow target %s", cfg.ShadowTarget)
+	}
+	if replaying {
+		log.Warn().Msgf("replaying responses recorded in %s instead of proxying", cfg.RecordReplay)
+	} else if len(cfg.RecordReplay) > 0 {
+		log.Warn().Msgf("recording responses by request hash to %s", cfg.RecordReplay)
+	}
+	if cfg.ForwardProxy {
+		log.Warn().Msg("forward proxy mode enabled, absolute URLs and CONNECT are proxied to their own host")
+	}
+	if cfg.GlobalRateLimit > 0 {
+		log.Warn().Msgf("limiting all traffic to %g requests/s (burst %d)", cfg.GlobalRateLimit, cfg.GlobalRateBurst)
+	}
+	if cfg.RateLimit > 0 {
+		log.Warn().Msgf("limiting clients to %g requests/s (burst %d, mode %s)", cfg.RateLimit, cfg.RateBurst, cfg.RateMode)
+	}
+	for _, route := range proxy.routeLimits {
+		log.Warn().Msgf("limiting clients under %s to %s (mode %s)", route.prefix, route.spec, cfg.RateMode)
+	}
+	if len(cfg.BoneFolder) > 0 {
+		log.Warn().Msgf("sniffed bones will be written to %s", cfg.BoneFolder)
+		if len(cfg.BoneFolderErrors) > 0 {
+			log.Warn().Msgf("bones of 4xx/5xx responses will be written to %s", cfg.BoneFolderErrors)
+		}
+		if cfg.BoneWriteWorkers > 0 && !cfg.StrictCapture {
+			writers = startBoneWriters(cfg.BoneWriteWorkers, cfg.BoneWriteQueue)
+			log.Warn().Msgf("writing bones with %d workers (queue %d, %s when full)", cfg.BoneWriteWorkers, cfg.BoneWriteQueue, cfg.BoneWriteBackpressure)
+		}
+		if cfg.RingSize > 0 {
+			ring = newBoneRing(cfg.RingSize)
+			log.Warn().Msgf("holding bones of the last %d transactions in memory until a 5xx or /.bloodhound/dump", cfg.RingSize)
+			if cfg.AdminToken == "" {
+				log.Warn().Msgf("%sdump is disabled until AdminToken is set", adminPrefix)
+			}
+		}
+
+		if len(cfg.BoneHook) > 0 {
+			startBoneHooks()
+			log.Warn().Msgf("running bone hook %s with %d workers", cfg.BoneHook, cfg.BoneHookWorkers)
+		}
+	}
+	if cfg.LiveStream {
+		if cfg.AdminToken == "" {
+			fatal(exitConfig, "LiveStream needs AdminToken, %sstream is served on the proxied listener", adminPrefix)
+		}
+		live = newStreamHub()
+		server.RegisterOnShutdown(live.close)
+		log.Warn().Msgf("streaming transactions as server-sent events on %sstream", adminPrefix)
+	}
+	if len(cfg.CloudEventsSink) > 0 {
+		if cloudEvents, err = newCloudEventSink(cfg.CloudEventsSink); err != nil {
+			fatal(exitConfig, "invalid CloudEventsSink %s: %v", cfg.CloudEventsSink, err)
+		}
+		log.Warn().Msgf("posting transactions as CloudEvents to %s", cfg.CloudEventsSink)
+	}
+	if cfg.StatsInterval > 0 {
+		go interval.logEvery(cfg.StatsInterval)
+	}
+	if cfg.HeartbeatInterval > 0 {
+		go stats.heartbeat(cfg.HeartbeatInterval)
+	}
+	if cfg.UsageInterval > 0 {
+		go usage.logEvery(cfg.UsageInterval, cfg.UsageCumulative)
+	}
+
+	// Shut down gracefully on SIGINT/SIGTERM
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		log.Warn().Msgf("received %s, shutting down (grace period %s)", sig, cfg.ShutdownTimeout)
+
+		// Shed keep-alive clients first so they reconnect elsewhere
+		draining.Store(true)
+		server.SetKeepAlivesEnabled(false)
+		if cfg.DrainPeriod > 0 {
+			log.Warn().Str("phase", "drain").Dur("drainPeriod", cfg.DrainPeriod).Msg("Draining keep-alive connections")
+			time.Sleep(cfg.DrainPeriod)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Error().Msgf("ERROR during shutdown : %v", err)
+		}
+		if bonesDB != nil {
+			if err := bonesDB.close(); err != nil {
+				log.Error().Msgf("ERROR closing BoneDB : %v", err)
+			}
+		}
+		if writers != nil {
+			writers.close()
+		}
+		if cloudEvents != nil {
+			cloudEvents.close()
+		}
+		if audit != nil {
+			if err := audit.close(); err != nil {
+				log.Error().Msgf("ERROR closing AuditLog : %v", err)
+			}
+		}
+		if len(cfg.BoneFolder) > 0 {
+			if err := stats.writeSummary(cfg.BoneFolder); err != nil {
+				log.Error().Msgf("ERROR writing session summary : %v", err)
+			}
+		}
+		close(stopped)
+	}()
+
+	// Start the server
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fatal(exitBind, "Server failed to start: %v", err)
+	}
+	if cfg.SelfTest {
+		go selfTest(cfg.TargetUrl, proxy.proxy.Transport)
+	}
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		fatal(exitBind, "Server failed to start: %v", err)
 	}
+	<-stopped
+	log.Warn().Msg("shutdown complete")
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// newTestProxy loads the default Config with the given overrides, a bone
+// folder in a temp dir, and returns a proxy to upstream along with the
+// folder
+func newTestProxy(t *testing.T, upstream *httptest.Server, overrides map[string]string) (*SniffingProxy, string) {
+	t.Helper()
+	folder := t.TempDir()
+	t.Setenv("BoneFolder", folder)
+	for name, value := range overrides {
+		t.Setenv(name, value)
+	}
+	var err error
+	if cfg, err = env.ParseAs[Config](); err != nil {
+		t.Fatalf("parsing config: %v", err)
+	}
+	sp, err := NewSniffingProxy(upstream.URL)
+	if err != nil {
+		t.Fatalf("creating proxy: %v", err)
+	}
+	return sp, folder
+}
+
+// readBone returns the contents of the single bone in folder ending in name
+func readBone(t *testing.T, folder, name string) string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(folder, "*-"+name))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected one %s bone in %s, found %v", name, folder, matches)
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatalf("reading bone: %v", err)
+	}
+	return string(data)
+}
+
+func TestResponseTrailersCaptured(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "hello trailers")
+		w.(http.Flusher).Flush()
+		// Only known once the body has been sent
+		w.Header().Set(http.TrailerPrefix+"X-Checksum", "abc123")
+	}))
+	defer upstream.Close()
+	sp, folder := newTestProxy(t, upstream, nil)
+
+	rec := httptest.NewRecorder()
+	sp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trailers", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if body := rec.Body.String(); body != "hello trailers" {
+		t.Errorf("client body = %q, want %q", body, "hello trailers")
+	}
+
+	bone := readBone(t, folder, "response.txt")
+	headers, body, ok := strings.Cut(bone, "\n\n")
+	if !ok {
+		t.Fatalf("bone has no header/body separator:\n%s", bone)
+	}
+	if !strings.Contains(headers, "--- trailers ---\nX-Checksum: abc123") {
+		t.Errorf("bone headers lack the trailer value:\n%s", headers)
+	}
+	if body != "hello trailers" {
+		t.Errorf("bone body = %q, want %q", body, "hello trailers")
+	}
+}
+
+func TestPropfindCaptured(t *testing.T) {
+	const propfind = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" {
+			t.Errorf("upstream method = %q, want PROPFIND", r.Method)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != propfind {
+			t.Errorf("upstream body = %q, want %q", body, propfind)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(207)
+		io.WriteString(w, `<multistatus xmlns="DAV:"/>`)
+	}))
+	defer upstream.Close()
+	sp, folder := newTestProxy(t, upstream, nil)
+
+	req := httptest.NewRequest("PROPFIND", "/dav/folder/", strings.NewReader(propfind))
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	rec := httptest.NewRecorder()
+	sp.ServeHTTP(rec, req)
+	if rec.Code != 207 {
+		t.Fatalf("status = %d, want 207", rec.Code)
+	}
+
+	bone := readBone(t, folder, "request.txt")
+	if !strings.HasPrefix(bone, "PROPFIND /dav/folder/ HTTP/1.1\n") {
+		t.Errorf("bone does not start with the PROPFIND request line:\n%s", bone)
+	}
+	if !strings.Contains(bone, "\nDepth: 1\n") {
+		t.Errorf("bone lacks the Depth header:\n%s", bone)
+	}
+	if _, body, _ := strings.Cut(bone, "\n\n"); body != propfind {
+		t.Errorf("bone body = %q, want %q", body, propfind)
+	}
+	if response := readBone(t, folder, "response.txt"); !strings.HasPrefix(response, "HTTP/1.1 207 Multi-Status\n") {
+		t.Errorf("response bone does not start with the 207 status line:\n%s", response)
+	}
+}
+
+func TestMaxUpstreamConnsReleasedAfterCapture(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer upstream.Close()
+	sp, _ := newTestProxy(t, upstream, map[string]string{
+		"MaxUpstreamConns":     "2",
+		"UpstreamQueueTimeout": "100ms",
+	})
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		sp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/captured", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i+1, rec.Code)
+		}
+	}
+}
+
+func TestBoneRotateClearsReusedSlot(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"a":2}`)
+	}))
+	defer upstream.Close()
+	sp, folder := newTestProxy(t, upstream, map[string]string{
+		"BoneRotate":  "1",
+		"DiffReqResp": "true",
+	})
+
+	// Only the JSON request gets a diff bone
+	for _, contentType := range []string{"application/json", "text/plain"} {
+		req := httptest.NewRequest(http.MethodPost, "/rotate", strings.NewReader(`{"a":1}`))
+		req.Header.Set("Content-Type", contentType)
+		sp.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(folder, "bone-0-*"))
+	for _, filename := range matches {
+		if strings.HasSuffix(filename, "-diff.txt") {
+			t.Errorf("slot still holds the previous request's diff bone: %v", matches)
+		}
+	}
+	if bone := readBone(t, folder, "request.txt"); !strings.Contains(bone, "Content-Type: text/plain") {
+		t.Errorf("request bone is not the latest request's:\n%s", bone)
+	}
+}
+
+func TestEchoRejectsOversizedBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("echo mode contacted the upstream")
+	}))
+	defer upstream.Close()
+	sp, _ := newTestProxy(t, upstream, map[string]string{
+		"EchoMode":        "true",
+		"MaxRequestBytes": "10",
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(strings.Repeat("x", 100)))
+	// Chunked, so the limit is only hit while reading
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	sp.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+}
+
+// earlyReadBody fails the test when it is read before sent is set, that is
+// by the proxy rather than while forwarding
+type earlyReadBody struct {
+	t    *testing.T
+	sent *bool
+	io.Reader
+}
+
+func (b earlyReadBody) Read(p []byte) (int, error) {
+	if !*b.sent {
+		b.t.Error("body read before it was forwarded")
+	}
+	return b.Reader.Read(p)
+}
+
+// sendingTransport marks the request as being forwarded once it reaches
+// the transport
+type sendingTransport struct {
+	sent *bool
+	next http.RoundTripper
+}
+
+func (st sendingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	*st.sent = true
+	return st.next.RoundTrip(req)
+}
+
+// sendingRecorder marks the response as being forwarded once its headers
+// are written to the client
+type sendingRecorder struct {
+	*httptest.ResponseRecorder
+	sent *bool
+}
+
+func (sr sendingRecorder) WriteHeader(code int) {
+	*sr.sent = true
+	sr.ResponseRecorder.WriteHeader(code)
+}
+
+func TestHeadersOnlyLeavesBodiesUnread(t *testing.T) {
+	for _, contentType := range []string{"application/xml", "application/octet-stream"} {
+		t.Run(contentType, func(t *testing.T) {
+			var requestSent, responseSent bool
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", contentType)
+				io.WriteString(w, "<a>body</a>")
+			}))
+			defer upstream.Close()
+			sp, _ := newTestProxy(t, upstream, map[string]string{
+				"HeadersOnly":       "true",
+				"HashIncludeBody":   "true",
+				"DetectContentType": "true",
+				"XMLToJSON":         "true",
+			})
+			sp.proxy.Transport = sendingTransport{sent: &requestSent, next: sp.proxy.Transport}
+			sp.proxy.ModifyResponse = func(next func(*http.Response) error) func(*http.Response) error {
+				return func(resp *http.Response) error {
+					resp.Body = io.NopCloser(earlyReadBody{t: t, sent: &responseSent, Reader: resp.Body})
+					return next(resp)
+				}
+			}(sp.proxy.ModifyResponse)
+
+			req := httptest.NewRequest(http.MethodPost, "/headers-only", earlyReadBody{t: t, sent: &requestSent, Reader: strings.NewReader("<b>request</b>")})
+			rec := sendingRecorder{ResponseRecorder: httptest.NewRecorder(), sent: &responseSent}
+			sp.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if body := rec.Body.String(); body != "<a>body</a>" {
+				t.Errorf("client body = %q, want the upstream's unchanged", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+)
+
+// boneDB stores one row per transaction in SQLite as a queryable
+// alternative to bone files
+type boneDB struct {
+	mu sync.Mutex
+	db *sql.DB
+}
+
+var bonesDB *boneDB
+
+const boneDBSchema = `CREATE TABLE IF NOT EXISTS transactions (
+	id TEXT PRIMARY KEY,
+	timestamp TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	duration_ms REAL NOT NULL,
+	request_headers TEXT,
+	request_body BLOB,
+	response_headers TEXT,
+	response_body BLOB
+)`
+
+func openBoneDB(path string) (*boneDB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection avoids SQLITE_BUSY between our own writers
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(boneDBSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boneDB{db: db}, nil
+}
+
+// insert records the transaction, reading the response body if the bone
+// writer hasn't already
+func (b *boneDB) insert(resp *http.Response, tx *transaction, reqID string) {
+	body := tx.responseBody
+	if body == nil {
+		body = readResponseBody(resp)
+	}
+	requestHeaders, _ := json.Marshal(resp.Request.Header)
+	responseHeaders, _ := json.Marshal(resp.Header)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.db.Exec(`INSERT OR REPLACE INTO transactions
+		(id, timestamp, method, url, status, duration_ms, request_headers, request_body, response_headers, response_body)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		reqID, tx.start.UTC().Format(time.RFC3339Nano), resp.Request.Method, resp.Request.URL.String(), resp.StatusCode,
+		float64(time.Since(tx.start))/float64(time.Millisecond), string(requestHeaders), redactStored(resp.Request.Header, tx.requestBody, reqID), string(responseHeaders), redactStored(resp.Header, body, reqID))
+	if err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR inserting transaction into BoneDB : %v", err)
+	}
+}
+
+func (b *boneDB) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.db.Close()
+}
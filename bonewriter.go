@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// boneWrite is a bone file waiting to be written by the writer pool
+type boneWrite struct {
+	filename string
+	data     []byte
+	reqID    string
+	hook     bool
+	// bodyHash is the DedupBodies hash of the response body the bone stores
+	bodyHash string
+}
+
+// boneWriters bounds the number of bone files written at once so bursts of
+// traffic don't exhaust file descriptors
+type boneWriters struct {
+	mu     sync.RWMutex
+	closed bool
+	queue  chan boneWrite
+	done   sync.WaitGroup
+}
+
+var writers *boneWriters
+
+func startBoneWriters(workers int, queueSize int) *boneWriters {
+	bw := &boneWriters{queue: make(chan boneWrite, max(queueSize, 1))}
+	for i := 0; i < workers; i++ {
+		bw.done.Add(1)
+		go func() {
+			defer bw.done.Done()
+			for job := range bw.queue {
+				writeJob(job)
+			}
+		}()
+	}
+	return bw
+}
+
+// queueBone writes a bone through the writer pool, or inline without one.
+// It returns false when the bone was dropped or could not be written.
+func queueBone(job boneWrite) bool {
+	if writers == nil {
+		return writeJob(job)
+	}
+	writers.mu.RLock()
+	defer writers.mu.RUnlock()
+	if writers.closed {
+		// Late bones after shutdown started are written inline
+		return writeJob(job)
+	}
+	if cfg.BoneWriteBackpressure == "drop" {
+		select {
+		case writers.queue <- job:
+			return true
+		default:
+			log.Warn().Str("id", job.reqID).Str("file", job.filename).Msg("bone write queue full, dropping bone")
+			return false
+		}
+	}
+	writers.queue <- job
+	return true
+}
+
+func writeJob(job boneWrite) bool {
+	if !saveBone(job.filename, job.data, job.reqID) {
+		return false
+	}
+	if job.bodyHash != "" {
+		storedBody(job.filename, job.bodyHash)
+	}
+	if job.hook {
+		queueBoneHook(job.filename, job.reqID)
+	}
+	return true
+}
+
+// close waits for queued bones to be written
+func (bw *boneWriters) close() {
+	bw.mu.Lock()
+	bw.closed = true
+	close(bw.queue)
+	bw.mu.Unlock()
+	bw.done.Wait()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// captureOnce arms a single capture of the next request matching pattern,
+// SIGUSR1 arms it again
+type captureOnce struct {
+	pattern *regexp.Regexp
+	armed   atomic.Bool
+}
+
+var once *captureOnce
+
+func newCaptureOnce(pattern string) (*captureOnce, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	co := &captureOnce{pattern: re}
+	co.arm()
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		for range sigs {
+			co.arm()
+		}
+	}()
+	return co, nil
+}
+
+func (co *captureOnce) arm() {
+	co.armed.Store(true)
+	log.Warn().Str("capture", "armed").Str("pattern", co.pattern.String()).Msg("Capture armed")
+}
+
+// fire reports whether r is the one request to capture, disarming if so
+func (co *captureOnce) fire(r *http.Request, reqID string) bool {
+	if !co.pattern.MatchString(r.URL.RequestURI()) || !co.armed.CompareAndSwap(true, false) {
+		return false
+	}
+	log.Warn().Str("capture", "fired").Str("pattern", co.pattern.String()).Str("method", r.Method).Str("url", r.URL.Path).Str("id", reqID).Msg("Capture fired")
+	return true
+}
+
+// shouldCapture decides once per request whether its bones are written,
+// marking tx forced when the client asked for the capture
+func (sp *SniffingProxy) shouldCapture(r *http.Request, tx *transaction, reqID string) bool {
+	if len(cfg.BoneFolder) == 0 {
+		return false
+	}
+	if captureTriggered(r) {
+		log.Info().Str("capture", "triggered").Str("header", cfg.CaptureTriggerHeader).Str("method", r.Method).Str("url", r.URL.Path).Str("id", reqID).Msg("Capture requested by client")
+		// Left out of MaxCaptureRate like CaptureOnce
+		tx.forced = true
+		return true
+	}
+	if once != nil {
+		// A single capture is never worth dropping
+		return once.fire(r, reqID)
+	}
+	return captureAllowed()
+}
+
+// responseHeaderRule limits captures to responses carrying a header, and
+// optionally a value matching a pattern, per CaptureIfResponseHeader
+type responseHeaderRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+var responseRule *responseHeaderRule
+
+// parseResponseHeaderRule parses a CaptureIfResponseHeader of the form Name
+// or Name=regexp
+func parseResponseHeaderRule(rule string) (*responseHeaderRule, error) {
+	name, value, hasValue := strings.Cut(rule, "=")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("expected Name or Name=regexp")
+	}
+	parsed := &responseHeaderRule{name: http.CanonicalHeaderKey(name)}
+	if hasValue {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		parsed.pattern = re
+	}
+	return parsed, nil
+}
+
+// matches reports whether header carries the rule's header with a matching
+// value
+func (rule *responseHeaderRule) matches(header http.Header) bool {
+	values, ok := header[rule.name]
+	if !ok {
+		return false
+	}
+	if rule.pattern == nil {
+		return true
+	}
+	for _, value := range values {
+		if rule.pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedByResponseRule reports whether CaptureIfResponseHeader drops the
+// capture of a response with header, which it never does for forced ones
+func (tx *transaction) skippedByResponseRule(header http.Header) bool {
+	return responseRule != nil && !tx.forced && !responseRule.matches(header)
+}
+
+// captureLimiter caps captured transactions per second to MaxCaptureRate
+var captureLimiter *rate.Limiter
+
+// droppedCaptures counts captures skipped by MaxCaptureRate since the last
+// log line
+var droppedCaptures atomic.Int64
+
+// captureAllowed takes a token for a capture, counting it as dropped when
+// MaxCaptureRate is exceeded
+func captureAllowed() bool {
+	if captureLimiter == nil || captureLimiter.Allow() {
+		return true
+	}
+	droppedCaptures.Add(1)
+	return false
+}
+
+// logDroppedCaptures logs how many captures MaxCaptureRate skipped, every
+// period in which any were
+func logDroppedCaptures(period time.Duration) {
+	for range time.Tick(period) {
+		if dropped := droppedCaptures.Swap(0); dropped > 0 {
+			log.Warn().Str("capture", "rate-limited").Int64("dropped", dropped).Dur("interval", period).Float64("maxCaptureRate", cfg.MaxCaptureRate).Msg("Captures dropped")
+		}
+	}
+}
+
+// captureTriggered reports whether the client asked for this request to be
+// captured through CaptureTriggerHeader
+func captureTriggered(r *http.Request) bool {
+	if len(cfg.CaptureTriggerHeader) == 0 {
+		return false
+	}
+	value := strings.TrimSpace(r.Header.Get(cfg.CaptureTriggerHeader))
+	if truthy, err := strconv.ParseBool(value); err == nil {
+		return truthy
+	}
+	switch strings.ToLower(value) {
+	case "yes", "on":
+		return true
+	}
+	return false
+}
+
+// heldBones keeps the bones of in-flight requests while CaptureSlowerThan
+// waits for their duration to decide whether they are written
+var heldBones = struct {
+	sync.Mutex
+	bones map[string][]boneWrite
+}{bones: make(map[string][]boneWrite)}
+
+// holdBones starts holding the bones of reqID
+func holdBones(reqID string) {
+	heldBones.Lock()
+	heldBones.bones[reqID] = nil
+	heldBones.Unlock()
+}
+
+// heldBone holds a bone of a request that is still in flight, and reports
+// false once the request is no longer held
+func heldBone(job boneWrite) bool {
+	heldBones.Lock()
+	defer heldBones.Unlock()
+	bones, ok := heldBones.bones[job.reqID]
+	if !ok {
+		return false
+	}
+	heldBones.bones[job.reqID] = append(bones, job)
+	return true
+}
+
+// releaseBones writes the held bones of reqID when the request took longer
+// than CaptureSlowerThan and drops them otherwise
+func releaseBones(reqID string, duration time.Duration) {
+	heldBones.Lock()
+	bones := heldBones.bones[reqID]
+	delete(heldBones.bones, reqID)
+	heldBones.Unlock()
+
+	if duration <= cfg.CaptureSlowerThan {
+		return
+	}
+	log.Info().Str("capture", "slow").Dur("duration", duration).Dur("captureSlowerThan", cfg.CaptureSlowerThan).Str("id", reqID).Msg("Capturing slow request")
+	for _, job := range bones {
+		storeBoneJob(job)
+	}
+}
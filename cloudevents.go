@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cloudEvent is a CloudEvents 1.0 event in structured JSON mode
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            streamEvent `json:"data"`
+}
+
+const (
+	cloudEventType     = "com.bloodhound.transaction"
+	cloudEventSource   = "bloodhound"
+	cloudEventQueue    = 1024
+	cloudEventAttempts = 5
+	cloudEventBackoff  = 500 * time.Millisecond
+)
+
+// cloudEventSink posts every completed transaction to CloudEventsSink from a
+// background worker, retrying failed posts with exponential backoff
+type cloudEventSink struct {
+	url     string
+	client  *http.Client
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan streamEvent
+	closing chan struct{}
+	done    sync.WaitGroup
+}
+
+var cloudEvents *cloudEventSink
+
+func newCloudEventSink(sink string) (*cloudEventSink, error) {
+	u, err := url.Parse(sink)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("must be an http or https URL")
+	}
+	s := &cloudEventSink{
+		url:     sink,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan streamEvent, cloudEventQueue),
+		closing: make(chan struct{}),
+	}
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		for event := range s.queue {
+			s.send(event)
+		}
+	}()
+	return s, nil
+}
+
+// publish queues a transaction, dropping it when the sink has fallen behind
+func (s *cloudEventSink) publish(event streamEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		log.Warn().Str("phase", "cloudevents").Str("id", event.ID).Msg("CloudEvents queue full, dropping event")
+	}
+}
+
+// send posts one event, retrying until it is accepted, the attempts run out
+// or shutdown cuts the backoff short
+func (s *cloudEventSink) send(event streamEvent) {
+	data, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.ID,
+		Source:          cloudEventSource,
+		Type:            cloudEventType,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		Data:            event,
+	})
+	if err != nil {
+		log.Error().Str("id", event.ID).Msgf("ERROR encoding CloudEvent : %v", err)
+		return
+	}
+
+	backoff := cloudEventBackoff
+	for attempt := 1; ; attempt++ {
+		err = s.post(data)
+		if err == nil {
+			return
+		}
+		if attempt == cloudEventAttempts {
+			break
+		}
+		log.Warn().Str("phase", "cloudevents").Int("attempt", attempt).Dur("backoff", backoff).Str("id", event.ID).Msgf("unable to send CloudEvent, retrying : %v", err)
+		select {
+		case <-time.After(backoff):
+		case <-s.closing:
+			log.Error().Str("id", event.ID).Msgf("ERROR sending CloudEvent, shutting down : %v", err)
+			return
+		}
+		backoff *= 2
+	}
+	log.Error().Str("id", event.ID).Int("attempts", cloudEventAttempts).Msgf("ERROR sending CloudEvent : %v", err)
+}
+
+func (s *cloudEventSink) post(data []byte) error {
+	resp, err := s.client.Post(s.url, "application/cloudevents+json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink answered %s", resp.Status)
+	}
+	return nil
+}
+
+// close sends the events still queued, without further retries
+func (s *cloudEventSink) close() {
+	s.mu.Lock()
+	s.closed = true
+	close(s.closing)
+	close(s.queue)
+	s.mu.Unlock()
+	s.done.Wait()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescingTransport shares one upstream call between identical GETs that
+// are in flight at the same time
+type coalescingTransport struct {
+	next  http.RoundTripper
+	group singleflight.Group
+
+	mu      sync.Mutex
+	waiters map[string]int
+}
+
+// coalescedResponse is the upstream answer every waiter gets a copy of
+type coalescedResponse struct {
+	resp *http.Response
+	body []byte
+	// unshared is set instead for streamed responses, which are fetched by
+	// every waiter on its own
+	unshared bool
+	// owner is the only request a private response is handed to
+	owner *http.Request
+}
+
+func newCoalescingTransport(next http.RoundTripper) *coalescingTransport {
+	return &coalescingTransport{next: next, waiters: make(map[string]int)}
+}
+
+// coalescable reports whether req is a safe, cacheable looking GET. Cookies
+// make responses as user specific as Authorization does.
+func coalescable(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.ContentLength > 0 {
+		return false
+	}
+	if req.Header.Get("Range") != "" || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return false
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return false
+	}
+	cacheControl := strings.ToLower(req.Header.Get("Cache-Control") + "," + req.Header.Get("Pragma"))
+	return !strings.Contains(cacheControl, "no-cache") && !strings.Contains(cacheControl, "no-store")
+}
+
+// streamedResponse reports whether a response of contentType is streamed to
+// the client rather than read in full
+func streamedResponse(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream" || isStreamType(contentType)
+}
+
+// privateResponse reports whether a response is meant for a single client,
+// setting a cookie or marked private or no-store
+func privateResponse(header http.Header) bool {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return true
+	}
+	cacheControl := strings.ToLower(strings.Join(header.Values("Cache-Control"), ","))
+	return strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store")
+}
+
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !coalescable(req) {
+		return t.next.RoundTrip(req)
+	}
+	// Clients negotiating a different encoding or type get their own call
+	key := req.Method + " " + req.URL.String() + "\n" + req.Header.Get("Accept-Encoding") + "\n" + req.Header.Get("Accept")
+
+	t.mu.Lock()
+	t.waiters[key]++
+	t.mu.Unlock()
+
+	v, err, _ := t.group.Do(key, func() (any, error) {
+		// The shared call must not die with whichever client started it
+		ctx := context.WithoutCancel(req.Context())
+		if cfg.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.RequestTimeout)
+			defer cancel()
+		}
+		resp, err := t.next.RoundTrip(req.WithContext(ctx))
+
+		t.mu.Lock()
+		shared := t.waiters[key]
+		delete(t.waiters, key)
+		t.mu.Unlock()
+		if shared > 1 {
+			reqID, _ := req.Context().Value(requestIDKey).(string)
+			log.Info().Str("phase", "coalesced").Str("method", req.Method).Str("url", req.URL.Path).Int("coalesced", shared).Str("id", reqID).Msg("Coalesced identical requests")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if streamedResponse(resp.Header.Get("Content-Type")) {
+			// Event streams never end and media is too large to hold, each
+			// waiter fetches these with its own context
+			resp.Body.Close()
+			return &coalescedResponse{unshared: true}, nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		coalesced := &coalescedResponse{resp: resp, body: body}
+		if privateResponse(resp.Header) {
+			// Only the client that started the call gets it, the others
+			// fetch their own
+			coalesced.owner = req
+		}
+		return coalesced, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shared := v.(*coalescedResponse)
+	if shared.unshared || (shared.owner != nil && shared.owner != req) {
+		return t.next.RoundTrip(req)
+	}
+	resp := new(http.Response)
+	*resp = *shared.resp
+	resp.Header = shared.resp.Header.Clone()
+	resp.Trailer = shared.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(shared.body))
+	resp.ContentLength = int64(len(shared.body))
+	resp.Request = req
+	return resp, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+const corsAllowMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// setCORSHeaders adds CORSOrigin's headers to h, allowing whatever headers
+// the browser asked for in a preflight
+func setCORSHeaders(h http.Header, req *http.Request) {
+	h.Set("Access-Control-Allow-Origin", cfg.CORSOrigin)
+	h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+	if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	} else {
+		h.Set("Access-Control-Allow-Headers", "*")
+	}
+	if cfg.CORSOrigin != "*" {
+		h.Add("Vary", "Origin")
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// answerPreflight replies to a preflight without hitting the upstream
+func answerPreflight(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w.Header(), r)
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	log.Info().Str("phase", "preflight").Str("url", r.URL.Path).Str("origin", r.Header.Get("Origin")).Str("requestMethod", r.Header.Get("Access-Control-Request-Method")).Str("remoteAddr", r.RemoteAddr).Msg("Answered CORS preflight")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// bodyDiff is the structural difference between two JSON documents, one
+// line per added, removed or changed field
+type bodyDiff struct {
+	added, removed, changed int
+	lines                   []string
+}
+
+// diffJSON compares a and b below path
+func (d *bodyDiff) diffJSON(path string, a, b any) {
+	aMap, aIsMap := a.(map[string]any)
+	bMap, bIsMap := b.(map[string]any)
+	if aIsMap && bIsMap {
+		keys := make(map[string]bool, len(aMap)+len(bMap))
+		for key := range aMap {
+			keys[key] = true
+		}
+		for key := range bMap {
+			keys[key] = true
+		}
+		for _, key := range sortedKeys(keys) {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			aValue, inA := aMap[key]
+			bValue, inB := bMap[key]
+			switch {
+			case !inA:
+				d.added++
+				d.lines = append(d.lines, fmt.Sprintf("+ %s: %s", child, jsonText(bValue)))
+			case !inB:
+				d.removed++
+				d.lines = append(d.lines, fmt.Sprintf("- %s: %s", child, jsonText(aValue)))
+			default:
+				d.diffJSON(child, aValue, bValue)
+			}
+		}
+		return
+	}
+
+	aList, aIsList := a.([]any)
+	bList, bIsList := b.([]any)
+	if aIsList && bIsList {
+		for i := 0; i < max(len(aList), len(bList)); i++ {
+			child := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(aList):
+				d.added++
+				d.lines = append(d.lines, fmt.Sprintf("+ %s: %s", child, jsonText(bList[i])))
+			case i >= len(bList):
+				d.removed++
+				d.lines = append(d.lines, fmt.Sprintf("- %s: %s", child, jsonText(aList[i])))
+			default:
+				d.diffJSON(child, aList[i], bList[i])
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		if path == "" {
+			path = "."
+		}
+		d.changed++
+		d.lines = append(d.lines, fmt.Sprintf("~ %s: %s -> %s", path, jsonText(a), jsonText(b)))
+	}
+}
+
+func jsonText(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// parseJSONBody decodes a JSON body, undoing its Content-Encoding first
+func parseJSONBody(header http.Header, body []byte) (any, bool) {
+	if !isJSON(header.Get("Content-Type")) || len(body) == 0 {
+		return nil, false
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := decodeBody(encoding, body)
+		if err != nil {
+			return nil, false
+		}
+		body = decoded
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+// diffBodies logs what the response changed compared to the request when
+// both bodies are JSON, writing the fields to a <id>-diff.txt bone
+func diffBodies(resp *http.Response, tx *transaction, reqID string) {
+	body := tx.responseBody
+	if body == nil {
+		body = readResponseBody(resp)
+	}
+	requestDoc, ok := parseJSONBody(resp.Request.Header, tx.requestBody)
+	if !ok {
+		return
+	}
+	responseDoc, ok := parseJSONBody(resp.Header, body)
+	if !ok {
+		return
+	}
+	// The diff quotes values, keep RedactJSONFields out of it like the bones
+	for _, path := range redactFields {
+		redactPath(requestDoc, path)
+		redactPath(responseDoc, path)
+	}
+
+	var diff bodyDiff
+	diff.diffJSON("", requestDoc, responseDoc)
+	tx.info().Str("phase", "diff").Str("method", resp.Request.Method).Str("url", resp.Request.URL.Path).Int("added", diff.added).Int("removed", diff.removed).Int("changed", diff.changed).Str("id", reqID).Msg("Response body compared to request")
+	if !tx.capture {
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", resp.Request.Method, resp.Request.URL.RequestURI())
+	fmt.Fprintf(&buf, "Added: %d\nRemoved: %d\nChanged: %d\n\n", diff.added, diff.removed, diff.changed)
+	for _, line := range diff.lines {
+		fmt.Fprintf(&buf, "%s\n", line)
+	}
+	writeBone(boneFilename(boneFolderFor(resp.StatusCode), time.Now(), reqID, "diff.txt"), buf.Bytes(), reqID)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// isForwardRequest reports whether req was sent to Bloodhound as a forward
+// proxy, with an absolute request URI naming its own destination
+func isForwardRequest(req *http.Request) bool {
+	return cfg.ForwardProxy && req.URL.IsAbs() && req.URL.Host != ""
+}
+
+// tunnel serves a CONNECT request by splicing the client connection onto a
+// fresh TCP connection to the requested host
+func (sp *SniffingProxy) tunnel(w http.ResponseWriter, r *http.Request, reqID string) {
+	log.Info().Str("phase", "connect").Str("target", r.Host).Str("remoteAddr", r.RemoteAddr).Str("id", reqID).Msg("Connect")
+
+	upstream, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		log.Error().Str("phase", "connect").Str("target", r.Host).Str("id", reqID).Msgf("ERROR connecting to tunnel target : %v", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Error().Str("phase", "connect").Str("target", r.Host).Str("id", reqID).Msgf("ERROR hijacking client connection : %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	// The server's read/write timeouts would otherwise cut long tunnels short
+	client.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Anything the client sent after the CONNECT line is already buffered
+		sent, _ = io.Copy(upstream, buffered)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		if tcp, ok := client.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	wg.Wait()
+
+	log.Info().Str("phase", "tunnel-closed").Str("target", r.Host).Int64("bytesSent", sent).Int64("bytesReceived", received).Str("id", reqID).Msg("Tunnel closed")
+}
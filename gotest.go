@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// goTestSkipHeaders are request headers that describe the proxy hop rather
+// than the request itself
+var goTestSkipHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Accept-Encoding":   true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Proto": true,
+}
+
+// goTestKeyHeaders are response headers worth asserting on
+var goTestKeyHeaders = []string{"Content-Type", "Content-Encoding", "Location", "Cache-Control"}
+
+var goTestTemplate = template.Must(template.New("gotest").Parse(`package bones
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test{{.Name}} replays {{.Method}} {{.URL}} captured by Bloodhound as
+// request {{.ID}}. Set handler to the http.Handler under test.
+func Test{{.Name}}(t *testing.T) {
+	req := httptest.NewRequest({{printf "%q" .Method}}, {{printf "%q" .URL}}, strings.NewReader({{printf "%q" .Body}}))
+{{- range .Headers}}
+	req.Header.Add({{printf "%q" .Name}}, {{printf "%q" .Value}})
+{{- end}}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != {{.StatusCode}} {
+		t.Errorf("status = %d, want {{.StatusCode}}", rec.Code)
+	}
+{{- range .Expect}}
+	if got := rec.Header().Get({{printf "%q" .Name}}); got != {{printf "%q" .Value}} {
+		t.Errorf("{{.Name}} = %q, want %q", got, {{printf "%q" .Value}})
+	}
+{{- end}}
+}
+`))
+
+type goTestHeader struct {
+	Name, Value string
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// writeGoTest emits a httptest based test stub for the transaction
+func writeGoTest(resp *http.Response, tx *transaction, reqID string) {
+	req := resp.Request
+	// The stub lands next to the bones, mask what they mask
+	body, _ := redactJSON(tx.requestBody, req.Header.Get("Content-Type"), reqID)
+	data := struct {
+		Name, ID, Method, URL, Body string
+		StatusCode                  int
+		Headers, Expect             []goTestHeader
+	}{
+		Name:       "Bone_" + nonIdentifier.ReplaceAllString(reqID, "_"),
+		ID:         reqID,
+		Method:     req.Method,
+		URL:        req.URL.RequestURI(),
+		Body:       string(body),
+		StatusCode: resp.StatusCode,
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if !goTestSkipHeaders[name] && name != http.CanonicalHeaderKey(traceHeader()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			data.Headers = append(data.Headers, goTestHeader{name, value})
+		}
+	}
+	for _, name := range goTestKeyHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			data.Expect = append(data.Expect, goTestHeader{name, value})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := goTestTemplate.Execute(&buf, data); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR rendering Go test : %v", err)
+		return
+	}
+	writeBone(boneFilename(boneFolderFor(resp.StatusCode), time.Now(), reqID, "bone_test.go"), buf.Bytes(), reqID)
+}
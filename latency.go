@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyRule delays requests whose path starts with prefix
+type latencyRule struct {
+	prefix string
+	delay  time.Duration
+}
+
+// parseLatencyRules parses LatencyRules entries of the form /prefix=duration
+func parseLatencyRules(rules []string) ([]latencyRule, error) {
+	var parsed []latencyRule
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		prefix, value, ok := strings.Cut(rule, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("latency rule %q: expected /path=duration", rule)
+		}
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("latency rule %q: invalid duration %q", rule, value)
+		}
+		parsed = append(parsed, latencyRule{prefix: prefix, delay: delay})
+	}
+	return parsed, nil
+}
+
+// injectLatency holds the request back by the delay of the first rule
+// matching its path, returning early if the request is canceled
+func (sp *SniffingProxy) injectLatency(r *http.Request, reqID string) {
+	for _, rule := range sp.latency {
+		if !strings.HasPrefix(r.URL.Path, rule.prefix) {
+			continue
+		}
+		transactionFrom(r.Context()).info().Str("phase", "latency").Str("method", r.Method).Str("url", r.URL.Path).Str("rule", rule.prefix).Dur("delay", rule.delay).Str("id", reqID).Msg("Injecting latency")
+		timer := time.NewTimer(rule.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		return
+	}
+}
+
+// lastRequest is when the latest request arrived in Unix nanoseconds, 0
+// until the first one
+var lastRequest atomic.Int64
+
+// coldStart reports whether the request arriving now is the first since
+// startup or, with IdleResetDuration, since an idle period longer than it
+func coldStart() bool {
+	now := time.Now().UnixNano()
+	previous := lastRequest.Swap(now)
+	if previous == 0 {
+		return true
+	}
+	return cfg.IdleResetDuration > 0 && time.Duration(now-previous) > cfg.IdleResetDuration
+}
+
+// injectColdStart holds a cold start request back by ColdStartDelay,
+// returning early if the request is canceled
+func injectColdStart(r *http.Request, reqID string) {
+	if !coldStart() {
+		return
+	}
+	transactionFrom(r.Context()).info().Str("phase", "latency").Bool("coldStart", true).Str("method", r.Method).Str("url", r.URL.Path).Dur("delay", cfg.ColdStartDelay).Str("id", reqID).Msg("Injecting cold start delay")
+	timer := time.NewTimer(cfg.ColdStartDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
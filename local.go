@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// localPaths maps paths answered by Bloodhound itself to their status
+var localPaths map[string]int
+
+// parseLocalPaths parses LocalPaths entries of the form path=status
+func parseLocalPaths(entries []string) (map[string]int, error) {
+	var paths map[string]int
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, status, ok := strings.Cut(entry, "=")
+		code, err := strconv.Atoi(status)
+		if !ok || !strings.HasPrefix(path, "/") || err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("local path %q: expected /path=status", entry)
+		}
+		if paths == nil {
+			paths = make(map[string]int)
+		}
+		paths[path] = code
+	}
+	return paths, nil
+}
+
+// serveLocal answers requests for LocalPaths with an empty body and reports
+// whether it did
+func serveLocal(w http.ResponseWriter, r *http.Request) bool {
+	status, ok := localPaths[r.URL.Path]
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// boneMetadataTitle opens the BoneMetadata block of a bone
+const boneMetadataTitle = "Bloodhound"
+
+// writeBoneMetadata starts a bone with the BoneMetadata comment block, each
+// line carrying BoneMetadataPrefix so parsers can strip it. The duration is
+// left out of bones written before the upstream answered.
+func writeBoneMetadata(buf *bytes.Buffer, req *http.Request, reqID string, answered bool) {
+	if !cfg.BoneMetadata {
+		return
+	}
+	tx := transactionFrom(req.Context())
+	prefix := cfg.BoneMetadataPrefix
+	fmt.Fprintf(buf, "%s%s\n", prefix, boneMetadataTitle)
+	fmt.Fprintf(buf, "%sid: %s\n", prefix, reqID)
+	fmt.Fprintf(buf, "%stimestamp: %s\n", prefix, tx.start.Format(time.RFC3339Nano))
+	fmt.Fprintf(buf, "%sclient: %s\n", prefix, clientIP(req))
+	fmt.Fprintf(buf, "%starget: %s\n", prefix, req.URL.String())
+	if answered {
+		fmt.Fprintf(buf, "%sduration: %s\n", prefix, time.Since(tx.start))
+	}
+}
+
+// stripBoneMetadata removes a leading BoneMetadata block from a bone
+func stripBoneMetadata(data []byte) []byte {
+	prefix := []byte(cfg.BoneMetadataPrefix)
+	if len(prefix) == 0 || !bytes.HasPrefix(data, append(append([]byte(nil), prefix...), boneMetadataTitle...)) {
+		return data
+	}
+	for bytes.HasPrefix(data, prefix) {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return nil
+		}
+		data = data[end+1:]
+	}
+	return data
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// openAPIExample is one captured body and its media type
+type openAPIExample struct {
+	contentType string
+	body        string
+}
+
+// openAPIOperation collects examples for a single method and path, one
+// response example per status code
+type openAPIOperation struct {
+	method    string
+	path      string
+	request   *openAPIExample
+	responses map[int]openAPIExample
+}
+
+var openAPIExamples = struct {
+	sync.Mutex
+	operations map[string]*openAPIOperation
+}{operations: make(map[string]*openAPIOperation)}
+
+var nonFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// recordOpenAPIExample adds the transaction as an example unless its
+// method, path and status have been seen before, rewriting that
+// operation's examples file when something new is added
+func recordOpenAPIExample(resp *http.Response, tx *transaction, reqID string) {
+	req := resp.Request
+	key := req.Method + " " + req.URL.Path
+
+	openAPIExamples.Lock()
+	defer openAPIExamples.Unlock()
+	op, ok := openAPIExamples.operations[key]
+	if !ok {
+		op = &openAPIOperation{method: req.Method, path: req.URL.Path, responses: make(map[int]openAPIExample)}
+		openAPIExamples.operations[key] = op
+	}
+	if _, seen := op.responses[resp.StatusCode]; seen {
+		return
+	}
+
+	if op.request == nil && len(tx.requestBody) > 0 {
+		op.request = &openAPIExample{contentType: req.Header.Get("Content-Type"), body: exampleBody(req.Header, tx.requestBody, reqID)}
+	}
+	body := tx.responseBody
+	if body == nil {
+		body = readResponseBody(resp)
+	}
+	op.responses[resp.StatusCode] = openAPIExample{contentType: resp.Header.Get("Content-Type"), body: exampleBody(resp.Header, body, reqID)}
+
+	name := nonFilename.ReplaceAllString(strings.ToLower(op.method)+"_"+strings.Trim(op.path, "/"), "_") + ".examples.yaml"
+	if err := os.WriteFile(filepath.Join(cfg.OpenAPIExamples, name), op.yaml(), 0644); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR writing OpenAPI examples : %v", err)
+	}
+}
+
+// exampleBody returns a body as text, decoding it first if needed and with
+// RedactJSONFields masked
+func exampleBody(header http.Header, body []byte, reqID string) string {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && len(body) > 0 {
+		decoded, err := decodeBody(encoding, body)
+		if err != nil {
+			return "[undecodable body]"
+		}
+		body = decoded
+	}
+	if len(body) > 0 && !isTextual(header.Get("Content-Type")) {
+		return "[binary body omitted]"
+	}
+	body, _ = redactJSON(body, header.Get("Content-Type"), reqID)
+	return string(body)
+}
+
+func (op *openAPIOperation) yaml() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s %s, captured by Bloodhound\n", op.method, op.path)
+	fmt.Fprintf(&buf, "paths:\n  %s:\n    %s:\n", strconv.Quote(op.path), strings.ToLower(op.method))
+	if op.request != nil {
+		fmt.Fprintf(&buf, "      requestBody:\n")
+		op.request.write(&buf, 8)
+	}
+	fmt.Fprintf(&buf, "      responses:\n")
+
+	codes := make([]int, 0, len(op.responses))
+	for code := range op.responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		example := op.responses[code]
+		fmt.Fprintf(&buf, "        %q:\n          description: %s\n", strconv.Itoa(code), strconv.Quote(http.StatusText(code)))
+		example.write(&buf, 10)
+	}
+	return buf.Bytes()
+}
+
+// write emits the content block for the example at the given indentation
+func (e openAPIExample) write(buf *bytes.Buffer, indent int) {
+	pad := strings.Repeat(" ", indent)
+	mediaType, _, err := mime.ParseMediaType(e.contentType)
+	if err != nil || mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	fmt.Fprintf(buf, "%scontent:\n%s  %s:\n%s    examples:\n%s      captured:\n", pad, pad, strconv.Quote(mediaType), pad, pad)
+	if e.body == "" {
+		fmt.Fprintf(buf, "%s        value: \"\"\n", pad)
+		return
+	}
+	fmt.Fprintf(buf, "%s        value: |-\n", pad)
+	for _, line := range strings.Split(e.body, "\n") {
+		fmt.Fprintf(buf, "%s          %s\n", pad, strings.TrimRight(line, "\r"))
+	}
+}
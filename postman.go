@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+type postmanCollection struct {
+	Info     postmanInfo       `json:"info"`
+	Item     []postmanItem     `json:"item"`
+	Variable []postmanKeyValue `json:"variable"`
+}
+
+type postmanInfo struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+// postmanItem is either a folder with Item or a request
+type postmanItem struct {
+	Name    string          `json:"name"`
+	Item    []postmanItem   `json:"item,omitempty"`
+	Request *postmanRequest `json:"request,omitempty"`
+}
+
+type postmanRequest struct {
+	Method string            `json:"method"`
+	Header []postmanKeyValue `json:"header"`
+	URL    postmanURL        `json:"url"`
+	Body   *postmanBody      `json:"body,omitempty"`
+}
+
+type postmanURL struct {
+	Raw   string            `json:"raw"`
+	Host  []string          `json:"host"`
+	Path  []string          `json:"path"`
+	Query []postmanKeyValue `json:"query,omitempty"`
+}
+
+type postmanBody struct {
+	Mode string `json:"mode"`
+	Raw  string `json:"raw"`
+}
+
+type postmanKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// postmanSkipHeaders are recomputed by Postman or only describe the hop
+// through Bloodhound
+var postmanSkipHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Connection":        true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Proto": true,
+}
+
+// exportPostman turns the request bones in folder into a Postman collection
+// with one request per method and path, grouped by the first path segment
+func exportPostman(out io.Writer, folder string, baseURL string) error {
+	files, err := filepath.Glob(filepath.Join(folder, "*-request.txt"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	seen := make(map[string]bool)
+	folders := make(map[string]int)
+	var items []postmanItem
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		req, err := parseRequestBone(data)
+		if err != nil {
+			log.Warn().Str("file", filepath.Base(file)).Msgf("skipping request bone : %v", err)
+			continue
+		}
+		name := req.Method + " " + req.URL.Path
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		request := &postmanRequest{Method: req.Method, Header: []postmanKeyValue{}}
+		for _, key := range sortedKeys(req.Header) {
+			if postmanSkipHeaders[key] {
+				continue
+			}
+			for _, value := range req.Header[key] {
+				request.Header = append(request.Header, postmanKeyValue{Key: key, Value: value})
+			}
+		}
+
+		var segments []string
+		for _, segment := range strings.Split(strings.Trim(req.URL.EscapedPath(), "/"), "/") {
+			if segment != "" {
+				segments = append(segments, segment)
+			}
+		}
+		request.URL = postmanURL{Raw: "{{baseUrl}}" + req.URL.RequestURI(), Host: []string{"{{baseUrl}}"}, Path: segments}
+		query := req.URL.Query()
+		for _, key := range sortedKeys(query) {
+			for _, value := range query[key] {
+				request.URL.Query = append(request.URL.Query, postmanKeyValue{Key: key, Value: value})
+			}
+		}
+
+		if body, _ := io.ReadAll(req.Body); len(body) > 0 {
+			request.Body = &postmanBody{Mode: "raw", Raw: string(body)}
+		}
+
+		item := postmanItem{Name: name, Request: request}
+		if len(segments) < 2 {
+			items = append(items, item)
+			continue
+		}
+		group, ok := folders[segments[0]]
+		if !ok {
+			group = len(items)
+			items = append(items, postmanItem{Name: segments[0]})
+			folders[segments[0]] = group
+		}
+		items[group].Item = append(items[group].Item, item)
+	}
+
+	collection := postmanCollection{
+		Info:     postmanInfo{Name: "Bloodhound capture " + filepath.Base(filepath.Clean(folder)), Schema: postmanSchema},
+		Item:     items,
+		Variable: []postmanKeyValue{{Key: "baseUrl", Value: strings.TrimSuffix(baseURL, "/")}},
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(collection)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
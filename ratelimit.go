@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// StatusClientClosedRequest is the non standard status nginx uses for a
+// client that went away before it was answered
+const StatusClientClosedRequest = 499
+
+// clientLimiters hands out a token bucket per client IP
+type clientLimiters struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*clientLimiter
+	// rule names the RouteRateLimits entry the limiters belong to
+	rule string
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiters(limit float64, burst int) *clientLimiters {
+	if burst < 1 {
+		burst = 1
+	}
+	cl := &clientLimiters{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: make(map[string]*clientLimiter),
+	}
+	go cl.cleanup(10 * time.Minute)
+	return cl
+}
+
+func (cl *clientLimiters) get(ip string) *rate.Limiter {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	c, ok := cl.limiters[ip]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(cl.limit, cl.burst)}
+		cl.limiters[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+// cleanup forgets clients that have been quiet for longer than idle
+func (cl *clientLimiters) cleanup(idle time.Duration) {
+	for range time.Tick(idle) {
+		cl.mu.Lock()
+		for ip, c := range cl.limiters {
+			if time.Since(c.lastSeen) > idle {
+				delete(cl.limiters, ip)
+			}
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// allow applies the client's limiter to r, either rejecting it with 429 or
+// delaying it according to cfg.RateMode. It returns false when a response
+// has already been written and the request must not be proxied.
+func (cl *clientLimiters) allow(w http.ResponseWriter, r *http.Request) bool {
+	ip := clientIP(r)
+	limiter := cl.get(ip)
+
+	if cfg.RateMode == "delay" {
+		ctx := r.Context()
+		if cfg.MaxThrottleDelay > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.MaxThrottleDelay)
+			defer cancel()
+		}
+		start := time.Now()
+		err := limiter.Wait(ctx)
+		if err == nil {
+			if waited := time.Since(start); waited > time.Millisecond {
+				log.Info().Str("phase", "throttle").Str("method", r.Method).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Dur("delay", waited).Msg("Request delayed")
+			}
+			return true
+		}
+		if r.Context().Err() != nil {
+			log.Warn().Str("phase", "throttle").Str("method", r.Method).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr).Dur("delay", time.Since(start)).Msg("Client went away while throttled")
+			w.WriteHeader(StatusClientClosedRequest)
+			return false
+		}
+		// The wait would have exceeded MaxThrottleDelay, fall back to rejecting
+	} else if limiter.Allow() {
+		return true
+	}
+
+	event := log.Warn().Str("phase", "rate-limited").Str("method", r.Method).Str("url", r.URL.Path).Str("remoteAddr", r.RemoteAddr)
+	if cl.rule != "" {
+		event = event.Str("rule", cl.rule)
+	}
+	event.Msg("Too many requests")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter(cl.limit)))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+// retryAfter is the number of whole seconds until a limiter of the given
+// rate next has a token
+func retryAfter(limit rate.Limit) int {
+	if limit <= 0 {
+		return 1
+	}
+	seconds := int(1 / float64(limit))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// clientIP returns the address of the connecting client without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttledReader caps the rate at which a body can be read to simulate a
+// slow network
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func newThrottledReader(ctx context.Context, body io.ReadCloser, bytesPerSec int) *throttledReader {
+	return &throttledReader{
+		ReadCloser: body,
+		ctx:        ctx,
+		limiter:    rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec),
+	}
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if burst := tr.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := tr.limiter.WaitN(tr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
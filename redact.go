@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// redactFields holds the RedactJSONFields paths split on dots
+var redactFields [][]string
+
+// redactQueryParams holds the RedactQueryParams names
+var redactQueryParams map[string]bool
+
+// redactMask replaces the values of redacted fields
+const redactMask = "***"
+
+// isJSON reports whether contentType is a JSON media type
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// redactJSON masks the RedactJSONFields of a JSON body written to a bone and
+// returns the number of fields masked. Bodies that do not parse are returned
+// as is with a warning
+func redactJSON(body []byte, contentType string, reqID string) ([]byte, int) {
+	if len(redactFields) == 0 || len(body) == 0 || !isJSON(contentType) {
+		return body, 0
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		log.Warn().Str("phase", "redact").Str("id", reqID).Msgf("unable to parse JSON body, capturing it unredacted : %v", err)
+		return body, 0
+	}
+
+	masked := 0
+	for _, path := range redactFields {
+		masked += redactPath(doc, path)
+	}
+	if masked == 0 {
+		return body, 0
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		log.Warn().Str("phase", "redact").Str("id", reqID).Msgf("unable to encode redacted JSON body, capturing it unredacted : %v", err)
+		return body, 0
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), masked
+}
+
+// redactStored masks the RedactJSONFields of a body stored outside the bones,
+// decoding it first when it is compressed. Bodies with masked fields are
+// returned decoded, others unchanged
+func redactStored(header http.Header, body []byte, reqID string) []byte {
+	if len(redactFields) == 0 || len(body) == 0 || !isJSON(header.Get("Content-Type")) {
+		return body
+	}
+	decoded := body
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		var err error
+		if decoded, err = decodeBody(encoding, body); err != nil {
+			log.Warn().Str("phase", "redact").Str("id", reqID).Msgf("unable to decode %s body, storing it unredacted : %v", encoding, err)
+			return body
+		}
+	}
+	if redacted, masked := redactJSON(decoded, header.Get("Content-Type"), reqID); masked > 0 {
+		return redacted
+	}
+	return body
+}
+
+// redactPath masks the field at path below value, descending into every
+// element of arrays on the way
+func redactPath(value any, path []string) int {
+	switch v := value.(type) {
+	case map[string]any:
+		child, ok := v[path[0]]
+		if !ok {
+			return 0
+		}
+		if len(path) == 1 {
+			v[path[0]] = redactMask
+			return 1
+		}
+		return redactPath(child, path[1:])
+	case []any:
+		masked := 0
+		for _, element := range v {
+			masked += redactPath(element, path)
+		}
+		return masked
+	}
+	return 0
+}
+
+// logQuery returns the raw query for the LogQuery field, with the values of
+// RedactQueryParams masked and the parameter order kept
+func logQuery(rawQuery string) string {
+	if len(redactQueryParams) == 0 || rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && redactQueryParams[unescaped] {
+			params[i] = name + "=" + redactMask
+		}
+	}
+	return strings.Join(params, "&")
+}
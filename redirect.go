@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// redirectTransport follows upstream redirects up to FollowRedirects hops so
+// the client and bones get the final response, writing each hop it skipped
+// to a <id>-redirect-<n>.txt bone
+type redirectTransport struct {
+	next http.RoundTripper
+}
+
+// redirectDrainLimit is how much of a skipped hop's body is read so its
+// connection can be reused
+const redirectDrainLimit = 64 << 10
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqID, _ := req.Context().Value(requestIDKey).(string)
+	tx := transactionFrom(req.Context())
+	visited := map[string]bool{req.URL.String(): true}
+
+	for hop := 1; ; hop++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || hop > cfg.FollowRedirects {
+			return resp, err
+		}
+		next, ok := redirectRequest(req, resp, tx)
+		if !ok {
+			return resp, nil
+		}
+		if visited[next.URL.String()] {
+			log.Warn().Str("phase", "redirect").Str("from", req.URL.String()).Str("to", next.URL.String()).Int("hop", hop).Str("id", reqID).Msg("Redirect loop, returning the redirect")
+			return resp, nil
+		}
+		visited[next.URL.String()] = true
+
+		log.Info().Str("phase", "redirect").Int("statusCode", resp.StatusCode).Str("from", req.URL.String()).Str("to", next.URL.String()).Int("hop", hop).Str("id", reqID).Msg("Following redirect")
+		if tx.capture {
+			writeRedirectBone(req, resp, hop, reqID)
+		}
+		io.CopyN(io.Discard, resp.Body, redirectDrainLimit)
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// redirectRequest builds the request following resp the way http.Client
+// would, reporting false when resp is not a redirect that can be followed.
+// 307 and 308 resend the body, which is only possible once it was buffered.
+func redirectRequest(req *http.Request, resp *http.Response, tx *transaction) (*http.Request, bool) {
+	location, err := resp.Location()
+	if err != nil {
+		return nil, false
+	}
+
+	next := req.Clone(req.Context())
+	next.URL = location
+	next.Host = ""
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			next.Method = http.MethodGet
+		}
+		next.Body = http.NoBody
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		switch {
+		case req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0:
+		case tx.requestBody != nil:
+			next.Body = io.NopCloser(bytes.NewReader(tx.requestBody))
+		default:
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if location.Host != req.URL.Host {
+		// Credentials stay with the host they were meant for
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	return next, true
+}
+
+// writeRedirectBone stores a redirect that was followed instead of being
+// returned to the client
+func writeRedirectBone(req *http.Request, resp *http.Response, hop int, reqID string) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\n", req.Method, req.URL.String(), req.Proto)
+	fmt.Fprintf(&buf, "%s %s\n", resp.Proto, resp.Status)
+	writeHeaders(&buf, resp.Header)
+	writeBone(boneFilename(boneFolderFor(resp.StatusCode), time.Now(), reqID, fmt.Sprintf("redirect-%d.txt", hop)), buf.Bytes(), reqID)
+}
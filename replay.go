@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// recordedResponse is a response stored by RecordReplay, keyed by the hash
+// of the request that got it
+type recordedResponse struct {
+	ID         string      `json:"id"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+func recordingFile(hash string) string {
+	return filepath.Join(cfg.RecordReplay, hash+".json")
+}
+
+// recordResponse stores resp under its request hash, the latest response to
+// identical requests wins
+func recordResponse(resp *http.Response, tx *transaction, reqID string) {
+	body := tx.responseBody
+	if body == nil {
+		body = readResponseBody(resp)
+	}
+	data, err := json.MarshalIndent(recordedResponse{
+		ID:         reqID,
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.RequestURI(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}, "", "  ")
+	if err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR encoding recorded response : %v", err)
+		return
+	}
+	if err := os.WriteFile(recordingFile(tx.requestHash), data, 0644); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR writing recorded response : %v", err)
+	}
+}
+
+// replay answers r with the response recorded for its request hash, or a
+// 404 when none was, without contacting the upstream
+func (sp *SniffingProxy) replay(w http.ResponseWriter, r *http.Request, reqID string) {
+	setRequestHash(r, r.URL.Path)
+	sp.sniffRequest(r, r.URL.Path, reqID)
+	tx := transactionFrom(r.Context())
+	if tx.capture {
+		sp.writeRequestToFile(r, reqID)
+		sp.writePendingBones(tx, boneFolderFor(http.StatusOK), reqID)
+	}
+
+	data, err := os.ReadFile(recordingFile(tx.requestHash))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error().Str("id", reqID).Msgf("ERROR reading recorded response : %v", err)
+		}
+		log.Warn().Str("phase", "replay").Str("method", r.Method).Str("url", r.URL.Path).Str("reqHash", tx.requestHash).Str("id", reqID).Msg("No recorded response")
+		http.Error(w, "no recorded response", http.StatusNotFound)
+		return
+	}
+	var recorded recordedResponse
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR decoding recorded response : %v", err)
+		http.Error(w, "corrupt recorded response", http.StatusInternalServerError)
+		return
+	}
+
+	tx.info().Str("phase", "replay").Str("method", r.Method).Str("url", r.URL.Path).Str("reqHash", tx.requestHash).Str("recordedID", recorded.ID).Int("statusCode", recorded.StatusCode).Str("id", reqID).Msg("Replayed recorded response")
+	for name, values := range recorded.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(recorded.Body)))
+	w.WriteHeader(recorded.StatusCode)
+	w.Write(recorded.Body)
+}
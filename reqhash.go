@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// requestHash is a stable digest of what makes two requests the same:
+// method, cleaned path, sorted query and, when configured, the
+// HashIncludeHeaders values and the body
+func requestHash(req *http.Request, clientPath string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + "\n"))
+	h.Write([]byte(path.Clean("/"+clientPath) + "\n"))
+	// Encode sorts by key
+	h.Write([]byte(req.URL.Query().Encode() + "\n"))
+
+	names := make([]string, 0, len(cfg.HashIncludeHeaders))
+	for _, name := range cfg.HashIncludeHeaders {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name + ": " + strings.Join(req.Header.Values(name), ", ") + "\n"))
+	}
+
+	if cfg.HashIncludeBody {
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// setRequestHash stores the hash of req on its transaction
+func setRequestHash(req *http.Request, clientPath string) {
+	var body []byte
+	// HeadersOnly forwards request bodies without ever reading them
+	if cfg.HashIncludeBody && !cfg.HeadersOnly {
+		body = readRequestBody(req)
+	}
+	transactionFrom(req.Context()).requestHash = requestHash(req, clientPath, body)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ringBone is a bone file held in memory until the ring is flushed
+type ringBone struct {
+	filename string
+	data     []byte
+	hook     bool
+	bodyHash string
+}
+
+// boneRing keeps the bones of the last size transactions in memory instead
+// of writing them, until something interesting asks for them to be flushed
+type boneRing struct {
+	mu    sync.Mutex
+	size  int
+	order []string
+	bones map[string][]ringBone
+}
+
+var ring *boneRing
+
+func newBoneRing(size int) *boneRing {
+	return &boneRing{size: size, bones: make(map[string][]ringBone)}
+}
+
+func (br *boneRing) add(job boneWrite) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if _, ok := br.bones[job.reqID]; !ok {
+		br.order = append(br.order, job.reqID)
+		if len(br.order) > br.size {
+			delete(br.bones, br.order[0])
+			br.order = br.order[1:]
+		}
+	}
+	br.bones[job.reqID] = append(br.bones[job.reqID], ringBone{filename: job.filename, data: job.data, hook: job.hook, bodyHash: job.bodyHash})
+}
+
+// flush writes every held bone to disk and empties the ring, returning the
+// number of transactions written
+func (br *boneRing) flush(reason string) int {
+	br.mu.Lock()
+	order, bones := br.order, br.bones
+	br.order, br.bones = nil, make(map[string][]ringBone)
+	br.mu.Unlock()
+
+	for _, reqID := range order {
+		for _, bone := range bones[reqID] {
+			queueBone(boneWrite{filename: bone.filename, data: bone.data, reqID: reqID, hook: bone.hook, bodyHash: bone.bodyHash})
+		}
+	}
+	log.Warn().Str("phase", "ring-flush").Str("reason", reason).Int("transactions", len(order)).Msg("Flushed capture ring")
+	return len(order)
+}
+
+// serveDump flushes the ring on demand
+func (br *boneRing) serveDump(w http.ResponseWriter, r *http.Request) {
+	flushed := br.flush("dump")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"transactions": flushed})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// slotOwners holds the request each BoneRotate slot currently belongs to.
+// The lock is held while a bone is written so a slot is never cleared
+// under a write.
+var slotOwners = struct {
+	sync.Mutex
+	ids map[int]string
+}{ids: make(map[int]string)}
+
+// requestCounter returns the counter part of a request ID, UUIDs have none
+func requestCounter(reqID string) (uint64, bool) {
+	n, err := strconv.ParseUint(reqID[strings.LastIndex(reqID, "-")+1:], 10, 64)
+	return n, err == nil
+}
+
+// rotationSlot picks the BoneRotate slot of a request, the counter part of
+// the request ID modulo the number of slots
+func rotationSlot(reqID string) int {
+	if n, ok := requestCounter(reqID); ok {
+		return int(n % uint64(cfg.BoneRotate))
+	}
+	// UUIDs have no counter, spread them by hash instead
+	h := fnv.New32a()
+	h.Write([]byte(reqID))
+	return int(h.Sum32() % uint32(cfg.BoneRotate))
+}
+
+// claimSlot makes reqID the owner of its rotation slot, removing the bones
+// the previous owner left there so the slot never mixes two transactions.
+// It reports false when a later request already took the slot over. Must
+// be called with slotOwners locked.
+func claimSlot(reqID string) bool {
+	slot := rotationSlot(reqID)
+	previous := slotOwners.ids[slot]
+	if previous == reqID {
+		return true
+	}
+	if n, ok := requestCounter(reqID); ok && previous != "" {
+		if owner, ok := requestCounter(previous); ok && owner > n {
+			return false
+		}
+	}
+	slotOwners.ids[slot] = reqID
+
+	folders := []string{cfg.BoneFolder}
+	if len(cfg.BoneFolderErrors) > 0 && cfg.BoneFolderErrors != cfg.BoneFolder {
+		folders = append(folders, cfg.BoneFolderErrors)
+	}
+	for _, folder := range folders {
+		matches, _ := filepath.Glob(filepath.Join(folder, fmt.Sprintf("bone-%d-*", slot)))
+		for _, filename := range matches {
+			logOverwrite(filename, reqID)
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				log.Error().Str("id", reqID).Msgf("ERROR removing bone file %s : %v", filepath.Base(filename), err)
+			}
+		}
+	}
+	return true
+}
+
+// logOverwrite notes a rotation slot being reused by a new request
+func logOverwrite(filename string, reqID string) {
+	if info, err := os.Stat(filename); err == nil {
+		log.Info().Str("phase", "rotate").Str("file", filepath.Base(filename)).Time("previous", info.ModTime()).Str("id", reqID).Msg("Overwriting bone slot")
+	}
+}
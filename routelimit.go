@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeRateLimit limits each client on paths starting with prefix to its own
+// rate instead of RateLimit
+type routeRateLimit struct {
+	prefix   string
+	spec     string
+	limiters *clientLimiters
+}
+
+// rateUnits are the periods a RouteRateLimits rate may be given per
+var rateUnits = map[string]time.Duration{
+	"s":   time.Second,
+	"sec": time.Second,
+	"m":   time.Minute,
+	"min": time.Minute,
+	"h":   time.Hour,
+}
+
+// parseRouteRateLimits parses RouteRateLimits entries of the form
+// /prefix=count[/unit], the count being allowed in a burst
+func parseRouteRateLimits(rules []string) ([]routeRateLimit, error) {
+	var parsed []routeRateLimit
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		prefix, spec, ok := strings.Cut(rule, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("route rate limit %q: expected /path=count/unit", rule)
+		}
+		countText, unit, _ := strings.Cut(spec, "/")
+		period := time.Second
+		if unit != "" {
+			if period, ok = rateUnits[unit]; !ok {
+				return nil, fmt.Errorf("route rate limit %q: unit must be s, min or h", rule)
+			}
+		}
+		count, err := strconv.ParseFloat(countText, 64)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("route rate limit %q: invalid count %q", rule, countText)
+		}
+		limiters := newClientLimiters(count/period.Seconds(), int(count))
+		limiters.rule = prefix
+		parsed = append(parsed, routeRateLimit{prefix: prefix, spec: spec, limiters: limiters})
+	}
+	return parsed, nil
+}
+
+// matchRouteRateLimit returns the first rule whose prefix r's path starts
+// with, or nil
+func (sp *SniffingProxy) matchRouteRateLimit(r *http.Request) *routeRateLimit {
+	for i := range sp.routeLimits {
+		if strings.HasPrefix(r.URL.Path, sp.routeLimits[i].prefix) {
+			return &sp.routeLimits[i]
+		}
+	}
+	return nil
+}
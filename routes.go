@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// routeRule sends requests carrying header=value to its own upstream
+type routeRule struct {
+	header   string
+	value    string
+	target   *url.URL
+	director func(*http.Request)
+}
+
+// parseRouteRules parses RouteRules entries of the form header=value:url
+func parseRouteRules(rules []string) ([]routeRule, error) {
+	var parsed []routeRule
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		header, rest, ok := strings.Cut(rule, "=")
+		if !ok || header == "" {
+			return nil, fmt.Errorf("route rule %q: expected header=value:url", rule)
+		}
+		value, target, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("route rule %q: expected header=value:url", rule)
+		}
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("route rule %q: invalid target url %q", rule, target)
+		}
+		parsed = append(parsed, routeRule{
+			header:   http.CanonicalHeaderKey(header),
+			value:    value,
+			target:   u,
+			director: httputil.NewSingleHostReverseProxy(u).Director,
+		})
+	}
+	return parsed, nil
+}
+
+// matchRoute returns the first rule matching req, or nil
+func (sp *SniffingProxy) matchRoute(req *http.Request) *routeRule {
+	for i := range sp.routes {
+		if req.Header.Get(sp.routes[i].header) == sp.routes[i].value {
+			return &sp.routes[i]
+		}
+	}
+	return nil
+}
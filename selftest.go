@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// selfTest probes TargetUrl once through the upstream transport and logs
+// what it found. A failed probe is only warned about, the proxy keeps running.
+func selfTest(target string, transport http.RoundTripper) {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	start := time.Now()
+	resp, err := client.Get(target)
+	duration := time.Since(start)
+	if err != nil {
+		log.Error().Str("phase", "self-test").Str("target", target).Str("errorClass", classifyError(err)).Dur("duration", duration).Msgf("ERROR SELF-TEST FAILED, %s is not reachable : %v", target, err)
+		return
+	}
+	resp.Body.Close()
+
+	event := log.Warn()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		event = log.Error()
+	}
+	event = event.Str("phase", "self-test").Str("target", target).Int("statusCode", resp.StatusCode).Str("proto", resp.Proto).Dur("duration", duration)
+	if state := resp.TLS; state != nil {
+		event = event.Str("tlsVersion", tls.VersionName(state.Version)).Str("cipherSuite", tls.CipherSuiteName(state.CipherSuite)).Str("alpn", state.NegotiatedProtocol)
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			event = event.Str("certSubject", cert.Subject.String()).Str("certIssuer", cert.Issuer.String()).Time("certExpires", cert.NotAfter)
+		}
+	}
+	event.Msg("Self-test probe answered")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headerFlags collects repeated -H "Name: value" flags
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q must be Name: value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// parseRequestBone rebuilds the request stored in a request.txt bone
+func parseRequestBone(data []byte) (*http.Request, error) {
+	reader := bufio.NewReader(bytes.NewReader(stripBoneMetadata(data)))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("missing request line")
+	}
+	parts := strings.Fields(line)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("malformed request line %q", strings.TrimSpace(line))
+	}
+	uri, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed request URI %q: %v", parts[1], err)
+	}
+
+	req := &http.Request{Method: parts[0], URL: uri, Header: make(http.Header), Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1}
+	decoded := false
+	bodyEncoding := "raw"
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ": ")
+		switch {
+		case !ok || strings.Contains(name, "="):
+			// "--- cookies ---" section, the Cookie header carries the same
+		case strings.EqualFold(name, "X-Bloodhound-Decoded"):
+			decoded = true
+		case strings.EqualFold(name, "X-Bloodhound-Body-Encoding"):
+			bodyEncoding = value
+		case strings.EqualFold(name, "X-Bloodhound-Was-Chunked"):
+			req.TransferEncoding = []string{"chunked"}
+		case strings.HasPrefix(strings.ToLower(name), "x-bloodhound-"):
+		case strings.EqualFold(name, "Host"):
+			// The captured Host belongs to the proxy, not the new target
+		default:
+			req.Header.Add(name, value)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	switch bodyEncoding {
+	case "base64":
+		if body, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(body))); err != nil {
+			return nil, fmt.Errorf("malformed base64 body: %v", err)
+		}
+	case "quoted":
+		unquoted, err := strconv.Unquote(strings.TrimSpace(string(body)))
+		if err != nil {
+			return nil, fmt.Errorf("malformed quoted body: %v", err)
+		}
+		body = []byte(unquoted)
+	}
+	if decoded {
+		// The bone holds the decoded body, send it as such
+		req.Header.Del("Content-Encoding")
+	}
+	req.Header.Del("Content-Length")
+	req.ContentLength = int64(len(body))
+	if len(req.TransferEncoding) > 0 {
+		req.ContentLength = -1
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return req, nil
+}
+
+// sendBone sends the request in a bone to target and prints the response in
+// the bone format
+func sendBone(out io.Writer, path, target string, headers []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	req, err := parseRequestBone(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	// Same URL joining as the proxy
+	httputil.NewSingleHostReverseProxy(targetURL).Director(req)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return printResponse(out, resp)
+}
+
+// sendRawBone writes the bytes of a request.raw bone to target's host as
+// they are, Host header included, and prints the response in the bone format
+func sendRawBone(out io.Writer, path, target string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	method, _, ok := strings.Cut(string(data), " ")
+	if !ok {
+		return fmt.Errorf("%s: missing request line", path)
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	addr := targetURL.Host
+	if targetURL.Port() == "" {
+		port := "80"
+		if targetURL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(targetURL.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if targetURL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: targetURL.Hostname(), NextProtos: []string{"http/1.1"}})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		return err
+	}
+	return printResponse(out, resp)
+}
+
+// printResponse writes resp to out in the bone format
+func printResponse(out io.Writer, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", resp.Proto, resp.Status)
+	writeHeaders(&buf, resp.Header)
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && len(body) > 0 {
+		if decodedBody, err := decodeBody(encoding, body); err == nil {
+			fmt.Fprintf(&buf, "X-Bloodhound-Decoded: %s\n", encoding)
+			body = decodedBody
+		}
+	}
+	fmt.Fprintf(&buf, "\n")
+	buf.Write(body)
+	_, err = out.Write(buf.Bytes())
+	return err
+}
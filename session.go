@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sessionID returns the client's SessionCookie value, handing a new client
+// a fresh session in a Set-Cookie
+func sessionID(w http.ResponseWriter, r *http.Request, reqID string) string {
+	if cookie, err := r.Cookie(cfg.SessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	session := newUUID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.SessionCookie,
+		Value:    session,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Info().Str("phase", "session").Str("session", session).Str("cookie", cfg.SessionCookie).Str("remoteAddr", r.RemoteAddr).Str("id", reqID).Msg("New session")
+	return session
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// shadowResult is what one side of a shadowed request returned
+type shadowResult struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// shadow mirrors requests to a second upstream and compares its answers
+// with the primary's, without the client ever waiting on it
+type shadow struct {
+	target   *url.URL
+	director func(*http.Request)
+	client   *http.Client
+}
+
+func newShadow(target string, transport http.RoundTripper) (*shadow, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return &shadow{
+		target:   u,
+		director: httputil.NewSingleHostReverseProxy(u).Director,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Minute,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// start sends a copy of req to the shadow target. clientURL is the request
+// URL before the primary target was applied.
+func (sh *shadow) start(req *http.Request, clientURL url.URL, tx *transaction, reqID string) {
+	tx.primaryResult = make(chan *shadowResult, 1)
+	out := req.Clone(context.Background())
+	out.URL = &clientURL
+	out.Host = ""
+	out.RequestURI = ""
+	out.Body = io.NopCloser(bytes.NewReader(tx.requestBody))
+	out.ContentLength = int64(len(tx.requestBody))
+	sh.director(out)
+
+	capture, primary := tx.capture, tx.primaryResult
+	go func() {
+		start := time.Now()
+		var result *shadowResult
+		resp, err := sh.client.Do(out)
+		if err != nil {
+			log.Warn().Str("phase", "shadow").Str("method", out.Method).Str("url", out.URL.Path).Str("id", reqID).Msgf("shadow request failed : %v", err)
+		} else {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			result = &shadowResult{status: resp.StatusCode, header: resp.Header, body: body}
+		}
+		duration := time.Since(start)
+
+		var primaryResult *shadowResult
+		select {
+		case primaryResult = <-primary:
+		case <-time.After(time.Minute):
+		}
+		if primaryResult == nil || result == nil {
+			return
+		}
+		sh.compare(out, primaryResult, result, duration, capture, reqID)
+	}()
+}
+
+func (sh *shadow) compare(req *http.Request, primary, shadowed *shadowResult, duration time.Duration, capture bool, reqID string) {
+	statusDiffers := primary.status != shadowed.status
+	bodyDiffers := !bytes.Equal(primary.body, shadowed.body)
+
+	event := log.Info()
+	if statusDiffers || bodyDiffers {
+		event = log.Warn()
+	}
+	event.Str("phase", "shadow").Str("method", req.Method).Str("url", req.URL.Path).Int("statusCode", primary.status).Int("shadowStatusCode", shadowed.status).Bool("statusDiffers", statusDiffers).Bool("bodyDiffers", bodyDiffers).Int("bodyBytes", len(primary.body)).Int("shadowBodyBytes", len(shadowed.body)).Dur("shadowDuration", duration).Str("id", reqID).Msg("Shadow compared")
+
+	if !capture || (!statusDiffers && !bodyDiffers) {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(&buf, "Shadow-Target: %s\n", sh.target)
+	fmt.Fprintf(&buf, "Primary-Status: %d\n", primary.status)
+	fmt.Fprintf(&buf, "Shadow-Status: %d\n", shadowed.status)
+	// Bodies are compared as received, but written with RedactJSONFields masked
+	fmt.Fprintf(&buf, "\n--- primary body ---\n")
+	buf.Write(redactStored(primary.header, primary.body, reqID))
+	fmt.Fprintf(&buf, "\n--- shadow body ---\n")
+	buf.Write(redactStored(shadowed.header, shadowed.body, reqID))
+	writeBone(boneFilename(boneFolderFor(primary.status), time.Now(), reqID, "shadow.txt"), buf.Bytes(), reqID)
+}
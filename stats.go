@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDurationSamples bounds the memory used for percentile calculation, once
+// reached durations are reservoir sampled
+const maxDurationSamples = 10000
+
+// sessionStats accumulates totals over the lifetime of the process for the
+// summary written on shutdown
+type sessionStats struct {
+	started       time.Time
+	requests      atomic.Int64
+	bytesIn       atomic.Int64
+	bytesOut      atomic.Int64
+	totalDuration atomic.Int64
+
+	mu          sync.Mutex
+	statusCodes map[int]int64
+	durations   []time.Duration
+}
+
+var stats = &sessionStats{
+	started:     time.Now(),
+	statusCodes: make(map[int]int64),
+}
+
+// intervalStats counts requests and their latency per status class between
+// two StatsInterval log lines
+type intervalStats struct {
+	counts    [6]atomic.Int64
+	durations [6]atomic.Int64
+}
+
+var interval = &intervalStats{}
+
+func (s *intervalStats) record(statusCode int, duration time.Duration) {
+	class := statusCode / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	s.counts[class].Add(1)
+	s.durations[class].Add(int64(duration))
+}
+
+// logEvery logs and resets the per status class totals every period
+func (s *intervalStats) logEvery(period time.Duration) {
+	for range time.Tick(period) {
+		event := log.Info().Str("phase", "stats").Dur("interval", period)
+		for class := range s.counts {
+			count := s.counts[class].Swap(0)
+			total := s.durations[class].Swap(0)
+			if count == 0 {
+				continue
+			}
+			name := "other"
+			if class > 0 {
+				name = strconv.Itoa(class) + "xx"
+			}
+			event.Dict(name, zerolog.Dict().Int64("count", count).Dur("avgDuration", time.Duration(total/count)))
+		}
+		event.Msg("Interval stats")
+	}
+}
+
+// ipUsage is the traffic of one client IP
+type ipUsage struct {
+	requests int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+// clientUsage accounts traffic per client IP for the UsageInterval log
+type clientUsage struct {
+	mu   sync.Mutex
+	byIP map[string]*ipUsage
+}
+
+var usage = &clientUsage{byIP: make(map[string]*ipUsage)}
+
+func (u *clientUsage) record(ip string, bytesIn, bytesOut int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entry, ok := u.byIP[ip]
+	if !ok {
+		entry = &ipUsage{}
+		u.byIP[ip] = entry
+	}
+	entry.requests++
+	entry.bytesIn += bytesIn
+	entry.bytesOut += bytesOut
+}
+
+// logEvery logs one usage line per client IP every period, resetting the
+// counts unless cumulative
+func (u *clientUsage) logEvery(period time.Duration, cumulative bool) {
+	for range time.Tick(period) {
+		u.mu.Lock()
+		byIP := u.byIP
+		if cumulative {
+			byIP = make(map[string]*ipUsage, len(u.byIP))
+			for ip, entry := range u.byIP {
+				copied := *entry
+				byIP[ip] = &copied
+			}
+		} else {
+			u.byIP = make(map[string]*ipUsage)
+		}
+		u.mu.Unlock()
+
+		for _, ip := range sortedKeys(byIP) {
+			entry := byIP[ip]
+			log.Info().Str("phase", "usage").Dur("interval", period).Bool("cumulative", cumulative).Str("clientIP", ip).Int64("requests", entry.requests).Int64("bytesIn", entry.bytesIn).Int64("bytesOut", entry.bytesOut).Msg("Client usage")
+		}
+	}
+}
+
+// heartbeat logs that the proxy is alive every period, traffic or not
+func (s *sessionStats) heartbeat(period time.Duration) {
+	for range time.Tick(period) {
+		log.Info().Str("phase", "heartbeat").Str("uptime", time.Since(s.started).Round(time.Second).String()).Int64("requests", s.requests.Load()).Msg("Heartbeat")
+	}
+}
+
+func (s *sessionStats) record(statusCode int, bytesIn, bytesOut int64, duration time.Duration) {
+	interval.record(statusCode, duration)
+	n := s.requests.Add(1)
+	s.bytesIn.Add(bytesIn)
+	s.bytesOut.Add(bytesOut)
+	s.totalDuration.Add(int64(duration))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCodes[statusCode]++
+	if len(s.durations) < maxDurationSamples {
+		s.durations = append(s.durations, duration)
+	} else if i := rand.Int63n(n); i < maxDurationSamples {
+		s.durations[i] = duration
+	}
+}
+
+type sessionSummary struct {
+	Started       time.Time        `json:"started"`
+	Uptime        string           `json:"uptime"`
+	TotalRequests int64            `json:"totalRequests"`
+	StatusCodes   map[string]int64 `json:"statusCodes"`
+	BytesIn       int64            `json:"bytesIn"`
+	BytesOut      int64            `json:"bytesOut"`
+	AvgDuration   string           `json:"avgDuration"`
+	P50Duration   string           `json:"p50Duration"`
+	P90Duration   string           `json:"p90Duration"`
+	P99Duration   string           `json:"p99Duration"`
+}
+
+func (s *sessionStats) summary() sessionSummary {
+	s.mu.Lock()
+	codes := make(map[string]int64, len(s.statusCodes))
+	for code, count := range s.statusCodes {
+		codes[strconv.Itoa(code)] = count
+	}
+	durations := append([]time.Duration(nil), s.durations...)
+	s.mu.Unlock()
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	requests := s.requests.Load()
+	var avg time.Duration
+	if requests > 0 {
+		avg = time.Duration(s.totalDuration.Load() / requests)
+	}
+	return sessionSummary{
+		Started:       s.started,
+		Uptime:        time.Since(s.started).Round(time.Second).String(),
+		TotalRequests: requests,
+		StatusCodes:   codes,
+		BytesIn:       s.bytesIn.Load(),
+		BytesOut:      s.bytesOut.Load(),
+		AvgDuration:   avg.String(),
+		P50Duration:   percentile(durations, 50).String(),
+		P90Duration:   percentile(durations, 90).String(),
+		P99Duration:   percentile(durations, 99).String(),
+	}
+}
+
+// percentile returns the p-th percentile of an already sorted slice
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (s *sessionStats) writeSummary(folder string) error {
+	data, err := json.MarshalIndent(s.summary(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(folder, "session-summary.json"), append(data, '\n'), 0644)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// streamEvent is one completed transaction as sent to live subscribers
+type streamEvent struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"statusCode"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+// streamHub fans completed transactions out to every /.bloodhound/stream
+// subscriber, dropping subscribers that can't keep up
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]bool
+}
+
+var live *streamHub
+
+// streamBuffer is how many events a subscriber may fall behind
+const streamBuffer = 64
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: make(map[chan []byte]bool)}
+}
+
+func (h *streamHub) publish(event streamEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Str("id", event.ID).Msgf("ERROR encoding stream event : %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- data:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+			log.Warn().Str("phase", "stream").Msg("Dropped slow stream subscriber")
+		}
+	}
+}
+
+func (h *streamHub) subscribe() chan []byte {
+	ch := make(chan []byte, streamBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *streamHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close ends every subscription so shutdown doesn't wait on open streams
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// serve streams events to one subscriber as server-sent events
+func (h *streamHub) serve(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The server's write timeout would otherwise end the stream
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ch := h.subscribe()
+	defer h.unsubscribe(ch)
+	log.Info().Str("phase", "stream").Str("remoteAddr", r.RemoteAddr).Msg("Stream subscriber connected")
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: transaction\ndata: %s\n\n", data)
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			log.Info().Str("phase", "stream").Str("remoteAddr", r.RemoteAddr).Msg("Stream subscriber disconnected")
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// summaryURL is the URL of a transaction summary, the path plus the query as
+// LogQuery logs it
+func summaryURL(u *url.URL) string {
+	if !cfg.LogQuery || u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + logQuery(u.RawQuery)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// newTransport builds the transport used to reach the upstream, starting
+// from http.DefaultTransport's settings
+func newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if len(cfg.DialLocalAddr) > 0 {
+		localAddr, err := resolveLocalAddr(cfg.DialLocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = localAddr
+		log.Warn().Msgf("upstream connections will originate from %s", localAddr)
+	}
+	transport.DialContext = dialer.DialContext
+
+	if len(cfg.UpstreamProxy) > 0 {
+		proxyURL, err := url.Parse(cfg.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UpstreamProxy %q: %w", cfg.UpstreamProxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid UpstreamProxy %q: scheme must be http, https, socks5 or socks5h", cfg.UpstreamProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		log.Warn().Msgf("upstream connections will go through proxy %s", proxyURL.Redacted())
+	}
+
+	if len(cfg.UpstreamCertFile) > 0 || len(cfg.UpstreamKeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.UpstreamCertFile, cfg.UpstreamKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UpstreamCertFile/UpstreamKeyFile: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Warn().Msgf("upstream connections will present client certificate %s, expiring %s", cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.DisableKeepAlives = cfg.DisableKeepAlives
+	log.Warn().Msgf("upstream transport: maxIdleConns=%d maxIdleConnsPerHost=%d disableKeepAlives=%t", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.DisableKeepAlives)
+
+	return transport, nil
+}
+
+// resolveLocalAddr parses an IP or IP:port and checks it can be bound
+func resolveLocalAddr(addr string) (*net.TCPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	localAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DialLocalAddr %q: %w", cfg.DialLocalAddr, err)
+	}
+
+	// Binding the IP is the simplest check that it belongs to this host
+	probe, err := net.Listen("tcp", net.JoinHostPort(localAddr.IP.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("DialLocalAddr %q is not assignable: %w", cfg.DialLocalAddr, err)
+	}
+	probe.Close()
+	return localAddr, nil
+}
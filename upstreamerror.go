@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// classifyError names the kind of upstream failure behind err
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection-refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection-reset"
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	return "other"
+}
+
+// writeErrorBone documents a failed upstream call next to the other bones
+func writeErrorBone(req *http.Request, tx *transaction, class string, err error, reqID string) {
+	var buf bytes.Buffer
+	writeBoneMetadata(&buf, req, reqID, true)
+	fmt.Fprintf(&buf, "%s %s %s\n", req.Method, req.URL.RequestURI(), req.Proto)
+	fmt.Fprintf(&buf, "Host: %s\n", req.URL.Host)
+	fmt.Fprintf(&buf, "Error-Class: %s\n", class)
+	fmt.Fprintf(&buf, "Error: %v\n", err)
+	fmt.Fprintf(&buf, "Elapsed: %s\n", time.Since(tx.start))
+	writeBone(boneFilename(boneFolderFor(http.StatusBadGateway), time.Now(), reqID, "error.txt"), buf.Bytes(), reqID)
+}
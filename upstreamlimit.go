@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errUpstreamQueueTimeout fails requests that waited UpstreamQueueTimeout for
+// one of the MaxUpstreamConns slots
+var errUpstreamQueueTimeout = errors.New("timed out waiting for an upstream connection slot")
+
+// limitedTransport allows at most MaxUpstreamConns requests in flight to the
+// upstream, a slot being held until the response body is closed. Others
+// queue for up to UpstreamQueueTimeout.
+type limitedTransport struct {
+	next    http.RoundTripper
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+func newLimitedTransport(next http.RoundTripper, conns int) *limitedTransport {
+	return &limitedTransport{next: next, slots: make(chan struct{}, conns)}
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		if err := t.wait(req); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		<-t.slots
+		return nil, err
+	}
+	body := &slotBody{ReadCloser: resp.Body, release: func() { <-t.slots }}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// Upgraded connections need a writable body
+		resp.Body = &slotRWBody{slotBody: body, writer: rw}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// wait queues req for a slot
+func (t *limitedTransport) wait(req *http.Request) error {
+	t.waiting.Add(1)
+	defer t.waiting.Add(-1)
+
+	var timeout <-chan time.Time
+	if cfg.UpstreamQueueTimeout > 0 {
+		timer := time.NewTimer(cfg.UpstreamQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errUpstreamQueueTimeout
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// logQueue logs the slots in use and requests queued every period in which
+// any were
+func (t *limitedTransport) logQueue(period time.Duration) {
+	for range time.Tick(period) {
+		inUse, queued := len(t.slots), t.waiting.Load()
+		if inUse == 0 && queued == 0 {
+			continue
+		}
+		event := log.Info()
+		if queued > 0 {
+			event = log.Warn()
+		}
+		event.Str("phase", "upstream-queue").Int("inUse", inUse).Int("maxUpstreamConns", cap(t.slots)).Int64("queued", queued).Msg("Upstream connection slots")
+	}
+}
+
+// slotBody gives the slot back once the response body is closed
+type slotBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Read gives the slot back as soon as the body is drained, in case whoever
+// read it never closes it
+func (b *slotBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// slotRWBody is a slotBody that keeps the Write of an upgraded connection,
+// which ReverseProxy requires of 101 Switching Protocols responses
+type slotRWBody struct {
+	*slotBody
+	writer io.Writer
+}
+
+func (b *slotRWBody) Write(p []byte) (int, error) {
+	return b.writer.Write(p)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// wireTransport stores captured requests and responses the way they are
+// framed on the upstream connection, next to the director based bones
+type wireTransport struct {
+	sp   *SniffingProxy
+	next http.RoundTripper
+}
+
+func (t *wireTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqID, _ := req.Context().Value(requestIDKey).(string)
+	tx := transactionFrom(req.Context())
+	if !tx.capture {
+		return t.next.RoundTrip(req)
+	}
+	// Redirect hops after the first get numbered bones of their own
+	tx.wireHops++
+	suffix := ".txt"
+	if tx.wireHops > 1 {
+		suffix = fmt.Sprintf("-%d.txt", tx.wireHops)
+	}
+
+	dt := time.Now()
+	if dump, err := httputil.DumpRequestOut(req, !cfg.HeadersOnly); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR dumping wire request : %v", err)
+	} else {
+		t.sp.storeRequestBone(req, dt, reqID, "wire-request"+suffix, dump)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if tx.skippedByResponseRule(resp.Header) {
+		return resp, nil
+	}
+	// Streamed bodies would have to arrive in full before the client got
+	// any of them
+	if dump, err := httputil.DumpResponse(resp, !cfg.HeadersOnly && !streamedResponse(resp.Header.Get("Content-Type"))); err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR dumping wire response : %v", err)
+	} else {
+		writeBone(boneFilename(boneFolderFor(resp.StatusCode), time.Now(), reqID, "wire-response"+suffix), dump, reqID)
+	}
+	return resp, nil
+}
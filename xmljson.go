@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// isXML reports whether a Content-Type declares an XML body
+func isXML(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// convertXMLResponse replaces an XML response body with its JSON
+// equivalent, leaving the response untouched if the body doesn't parse
+func convertXMLResponse(resp *http.Response, reqID string) {
+	if resp.Body == nil || !isXML(resp.Header.Get("Content-Type")) {
+		return
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		log.Warn().Str("id", reqID).Str("encoding", encoding).Msg("not converting encoded XML response to JSON")
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Error().Str("id", reqID).Msgf("ERROR reading XML response body : %v", err)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return
+	}
+	if len(body) == 0 {
+		// HEAD, 204 and 304 have nothing to convert
+		resp.Body = http.NoBody
+		return
+	}
+
+	converted, err := xmlToJSON(body)
+	if err != nil {
+		log.Warn().Str("id", reqID).Str("url", resp.Request.URL.Path).Msgf("unable to convert XML response to JSON, passing it through : %v", err)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(converted))
+	resp.ContentLength = int64(len(converted))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(converted)))
+	resp.Header.Set("Content-Type", "application/json")
+}
+
+// xmlToJSON converts an XML document into JSON with the root element as the
+// only key. Attributes become "@name" keys, text next to child elements
+// becomes "#text" and repeated elements become arrays.
+func xmlToJSON(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("no root element")
+			}
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			value, err := decodeXMLElement(decoder, start)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]any{start.Name.Local: value})
+		}
+	}
+}
+
+func decodeXMLElement(decoder *xml.Decoder, start xml.StartElement) (any, error) {
+	fields := make(map[string]any)
+	for _, attr := range start.Attr {
+		fields["@"+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(decoder, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := fields[name].(type) {
+			case nil:
+				fields[name] = child
+			case []any:
+				fields[name] = append(existing, child)
+			default:
+				fields[name] = []any{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			content := strings.TrimSpace(text.String())
+			if len(fields) == 0 {
+				return content, nil
+			}
+			if content != "" {
+				fields["#text"] = content
+			}
+			return fields, nil
+		}
+	}
+}